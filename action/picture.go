@@ -4,37 +4,59 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/watsonserve/galleried/helper"
 	"github.com/watsonserve/galleried/services"
 )
 
 type PictureAction struct {
-	listSrv http.Handler
-	dav     http.Handler
+	listSrv  http.Handler
+	sheetSrv http.Handler
+	dav      http.Handler
+	jobSrv   http.Handler
+	imgCache map[string]bool
 }
 
-var imgCache = map[string]bool{"thumb": true, "preview": true, "raw": true}
-
-func NewPictureAction(listSrv http.Handler, fileSrv http.Handler) *PictureAction {
+func NewPictureAction(listSrv http.Handler, sheetSrv http.Handler, fileSrv http.Handler, jobSrv http.Handler, levels []helper.Level) *PictureAction {
+	imgCache := map[string]bool{"raw": true, "motion": true}
+	for _, level := range levels {
+		imgCache[level.Name] = true
+	}
 	return &PictureAction{
-		listSrv: listSrv,
-		dav:     fileSrv,
+		listSrv:  listSrv,
+		sheetSrv: sheetSrv,
+		dav:      fileSrv,
+		jobSrv:   jobSrv,
+		imgCache: imgCache,
 	}
 }
 
 func (d *PictureAction) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	subPath := req.URL.Path[9:]
 
+	query := req.URL.Query()
 	if "/" == subPath {
+		// ?sheet=contact|sprite|map
+		if query.Has("sheet") {
+			d.sheetSrv.ServeHTTP(resp, req)
+			return
+		}
 		d.listSrv.ServeHTTP(resp, req)
 		return
 	}
 
-	query := req.URL.Query()
+	// ?job=<id> from the Location of POST
+	if query.Has("job") {
+		d.jobSrv.ServeHTTP(resp, req)
+		return
+	}
 	lev := query.Get("lev")
 	if "" == lev {
 		lev = "raw"
 	}
-	if !imgCache[lev] {
+	// on-demand size
+	if query.Has("w") || query.Has("h") {
+		lev = "derived"
+	} else if !d.imgCache[lev] {
 		services.StdJSONResp(resp, nil, http.StatusNotFound, "")
 		return
 	}
@@ -0,0 +1,79 @@
+package dao
+
+// atime is coarse, a rendition is touched at most once an hour to spare a write each request
+const touchInterval = 3600
+
+// the renditions of a level in every encoding, in the order of the last use of any
+type CacheEntry struct {
+	ETag  string
+	Lev   string
+	Size  int64
+	ATime int64
+}
+
+func (dbi *DBI) TouchRendition(eTag, lev, extName string, now int64) error {
+	_, err := dbi.StmtMap["touch_rendition"].Exec(eTag, lev, extName, now, now-touchInterval)
+	return err
+}
+
+/**
+ * bytes of every rendition on the disk
+ */
+func (dbi *DBI) CacheSize() (int64, error) {
+	total := int64(0)
+	err := dbi.StmtMap["cache_size"].QueryRow().Scan(&total)
+	return total, err
+}
+
+/**
+ * the limit levels used least recently
+ */
+func (dbi *DBI) LRURenditions(limit int) ([]*CacheEntry, error) {
+	rows, err := dbi.StmtMap["lru_renditions"].Query(limit)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*CacheEntry, 0, limit)
+	for rows.Next() {
+		entry := &CacheEntry{}
+		err = rows.Scan(&entry.ETag, &entry.Lev, &entry.Size, &entry.ATime)
+		if nil != err {
+			return nil, err
+		}
+		list = append(list, entry)
+	}
+	return list, rows.Err()
+}
+
+/**
+ * every encoding of the level together, so the negotiation never falls back to another one
+ * @return the exts evicted, none when any has been used or regenerated since it was listed
+ */
+func (dbi *DBI) EvictRendition(entry *CacheEntry) ([]string, error) {
+	rows, err := dbi.StmtMap["evict_rendition"].Query(entry.ETag, entry.Lev, entry.ATime)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exts := make([]string, 0)
+	for rows.Next() {
+		var extName string
+		err = rows.Scan(&extName)
+		if nil != err {
+			return nil, err
+		}
+		exts = append(exts, extName)
+	}
+	return exts, rows.Err()
+}
+
+/**
+ * forget a rendition whose file is gone
+ */
+func (dbi *DBI) DropRendition(eTag, lev, extName string) error {
+	_, err := dbi.StmtMap["drop_rendition"].Exec(eTag, lev, extName)
+	return err
+}
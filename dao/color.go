@@ -0,0 +1,69 @@
+package dao
+
+import (
+	"strings"
+
+	"github.com/watsonserve/galleried/helper"
+)
+
+// the pictures of a colour within the distance in CIELAB, the closest first.
+// Only the colours of the user within the box around the swatch are measured
+const colorSQL = listColumns +
+	" JOIN (SELECT etag, min(sqrt(power(l-$2, 2)+power(a-$3, 2)+power(b-$4, 2))) AS dist FROM res_color" +
+	" WHERE l BETWEEN $2-$5 AND $2+$5 AND a BETWEEN $3-$5 AND $3+$5 AND b BETWEEN $4-$5 AND $4+$5" +
+	" AND etag IN (SELECT etag FROM res_user_img WHERE uid=$1 AND rtime=0) GROUP BY etag) c ON c.etag=u.etag" +
+	" WHERE u.rtime=0 AND u.uid=$1 AND c.dist<$5 GROUP BY u.id, t.blurhash, t.palette, t.animated, c.dist ORDER BY c.dist, u.ctime DESC OFFSET $6"
+
+/**
+ * replace the palette of the picture, the renders of the same picture one after another
+ */
+func (dbi *DBI) SetPalette(eTag string, list []helper.Swatch) error {
+	tx, err := dbi.db.Begin()
+	if nil != err {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Stmt(dbi.StmtMap["lock_thumb"]).Exec(eTag)
+	if nil == err {
+		_, err = tx.Stmt(dbi.StmtMap["del_colors"]).Exec(eTag)
+	}
+	if nil != err {
+		return err
+	}
+	colors := make([]string, 0, len(list))
+	for i, swatch := range list {
+		_, err = tx.Stmt(dbi.StmtMap["inst_color"]).Exec(eTag, i, swatch.L, swatch.A, swatch.B, swatch.Weight)
+		if nil != err {
+			return err
+		}
+		colors = append(colors, swatch.Color)
+	}
+	_, err = tx.Stmt(dbi.StmtMap["palette"]).Exec(eTag, strings.Join(colors, ","))
+	if nil != err {
+		return err
+	}
+	return tx.Commit()
+}
+
+/**
+ * pictures with a dominant colour closer to the swatch than the distance
+ */
+func (dbi *DBI) ColorSearch(uid string, swatch *helper.Swatch, distance float64, rangeList []helper.Segment) ([]ResUserImg, error) {
+	offset, length, err := pageOf(rangeList)
+	if nil != err {
+		return nil, err
+	}
+	args := []interface{}{uid, swatch.L, swatch.A, swatch.B, distance, offset}
+	stmt := dbi.StmtMap["color_list"]
+	if 0 < length {
+		args = append(args, length)
+		stmt = dbi.StmtMap["color_list_limit"]
+	}
+	rows, err := stmt.Query(args...)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanList(rows)
+}
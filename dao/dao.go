@@ -3,7 +3,7 @@ package dao
 import (
 	"database/sql"
 	"errors"
-	"path"
+	"strings"
 	"time"
 
 	"github.com/watsonserve/galleried/helper"
@@ -12,33 +12,132 @@ import (
 
 type DBI struct {
 	goengine.DAO
+	db *sql.DB // for the statements run in a transaction
+}
+
+type ResThumb struct {
+	ETag     string
+	Hash     string
+	Ext      string
+	Size     int64
+	CType    string
+	CId      string
+	Width    int
+	Height   int
+	Duration int64 // ms, videos only
+}
+
+// a file on the disk with the metadata recorded when it was created
+type FileMeta struct {
+	Name  string // baseName
+	Ext   string
+	Hash  string
+	Size  int64
+	CType string
+	Stale bool   // renditions only, generated by settings changed since
+	Crop  string // renditions only, fractions "x,y,w,h" of the original
+	// originals only, out of the decode limits
+	Unrenderable bool
+	// originals only, recompressed losslessly from jpeg into Name+Ext+ArchiveExt
+	Archived bool
+}
+
+/**
+ * extName of the original on the disk
+ */
+func (f *FileMeta) RawExt() string {
+	if f.Archived {
+		return f.Ext + helper.ArchiveExt
+	}
+	return f.Ext
 }
 
 type ResUserImg struct {
 	Filename string
 	ETag     string
 	CTime    int64
+	Levs     []string // renditions ready
+	BlurHash string   // placeholder painted before the thumb arrives, empty till generated
+	Palette  []string // dominant colours, #rrggbb, the heaviest first
+	Animated bool     // an animated gif or webp
 }
 
-const selectSQL = "SELECT filename, etag, ctime FROM res_user_img WHERE rtime=0 AND uid=$1 ORDER BY ctime DESC OFFSET=$2"
+const (
+	listColumns = "SELECT u.filename, u.etag, u.ctime, COALESCE(string_agg(r.lev, ',' ORDER BY r.lev), ''), COALESCE(t.blurhash, ''), COALESCE(t.palette, ''), COALESCE(t.animated, false)" +
+		" FROM res_user_img u LEFT JOIN res_thumb t ON t.etag=u.etag" +
+		" LEFT JOIN (SELECT DISTINCT etag, lev FROM res_rendition WHERE NOT stale) r ON r.etag=u.etag"
+	selectSQL = listColumns + " WHERE u.rtime=0 AND u.uid=$1 GROUP BY u.id, t.blurhash, t.palette, t.animated ORDER BY u.ctime DESC OFFSET $2"
+)
 
 func NewDAO(dbConn *sql.DB) *DBI {
 	dao := goengine.InitDAO(dbConn)
 	dao.Prepare("real_name", "SELECT raw FROM res_thumb WHERE hash=$1")
 	// GET
 	dao.Prepare("info", "SELECT etag FROM res_user_img WHERE uid=$1 AND filename=$2 AND rtime=0")
+	dao.Prepare("original", "SELECT etag, ext, hash, size, COALESCE(ctype, ''), unrenderable, archived FROM res_thumb WHERE etag=$1")
+	dao.Prepare("rendition", "SELECT etag, ext, hash, size, ctype, stale, crop FROM res_rendition WHERE etag=$1 AND lev=$2 AND ext=$3")
+	dao.Prepare("renditions", "SELECT etag, ext, hash, size, ctype, stale, crop FROM res_rendition WHERE etag=$1 AND lev=$2")
+	dao.Prepare("motion", "SELECT m.etag, m.ext, m.hash, m.size, COALESCE(m.ctype, '') FROM res_motion m JOIN res_thumb t ON m.cid=t.cid WHERE t.etag=$1 AND m.uid=$2")
+	dao.Prepare("motion_cid", "SELECT etag, ext, hash, size, COALESCE(ctype, '') FROM res_motion WHERE uid=$1 AND cid=$2")
 	// LIST
 	dao.Prepare("list", selectSQL)
-	dao.Prepare("list_limit", selectSQL+" LIMIT=$3")
+	dao.Prepare("list_limit", selectSQL+" LIMIT $3")
 	// DELETE
 	dao.Prepare("delt", "UPDATE res_user_img SET rtime=$3 WHERE uid=$1 AND filename=$2 AND rtime=0")
 	dao.Prepare("drop", "DELETE FROM res_user_img WHERE uid=$1 AND filename=$2 AND rtime<>0")
 	// PUT
-	dao.Prepare("inst", "INSERT INTO res_thumb (etag, hash, ext, size) VALUES ($1, $2, $3, $4)")
+	dao.Prepare("inst", "INSERT INTO res_thumb (etag, hash, ext, size, ctype, cid, width, height, duration) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9)")
+	dao.Prepare("inst_motion", "INSERT INTO res_motion (etag, uid, cid, hash, ext, size, ctype) VALUES ($1, $2, $3, $4, $5, $6, $7)")
+	dao.Prepare("updt_motion", "UPDATE res_motion SET etag=$1, hash=$4, ext=$5, size=$6, ctype=$7 WHERE uid=$2 AND cid=$3")
+	// POST
+	dao.Prepare("inst_rendition", "INSERT INTO res_rendition (etag, lev, ext, hash, size, ctype, sig, crop, atime) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"+
+		" ON CONFLICT (etag, lev, ext) DO UPDATE SET hash=EXCLUDED.hash, size=EXCLUDED.size, ctype=EXCLUDED.ctype, sig=EXCLUDED.sig, crop=EXCLUDED.crop, atime=EXCLUDED.atime, stale=false")
+	dao.Prepare("unrenderable", "UPDATE res_thumb SET unrenderable=$2 WHERE etag=$1")
+	dao.Prepare("blurhash", "UPDATE res_thumb SET blurhash=$2 WHERE etag=$1")
+	dao.Prepare("palette", "UPDATE res_thumb SET palette=$2 WHERE etag=$1")
+	dao.Prepare("animated", "UPDATE res_thumb SET animated=$2 WHERE etag=$1")
+	dao.Prepare("archived", "UPDATE res_thumb SET archived=$2 WHERE etag=$1")
+	dao.Prepare("lock_thumb", "SELECT etag FROM res_thumb WHERE etag=$1 FOR UPDATE")
+	dao.Prepare("del_colors", "DELETE FROM res_color WHERE etag=$1")
+	dao.Prepare("inst_color", "INSERT INTO res_color (etag, idx, l, a, b, weight) VALUES ($1, $2, $3, $4, $5, $6)")
+	dao.Prepare("color_list", colorSQL)
+	dao.Prepare("color_list_limit", colorSQL+" LIMIT $7")
+	dao.Prepare("sheet_list", "SELECT filename, etag FROM res_user_img WHERE rtime=0 AND uid=$1 AND $2<=ctime AND ctime<$3"+
+		" AND left(filename, length($5))=$5 ORDER BY ctime, id LIMIT $4")
+	dao.Prepare("stale_rendition", "UPDATE res_rendition r SET stale=true WHERE lev=$1 AND sig<>$2 AND NOT stale"+
+		" AND (sig<>$3 OR EXISTS (SELECT 1 FROM res_thumb t WHERE t.etag=r.etag AND t.animated))")
+	dao.Prepare("drop_encodings", "DELETE FROM res_rendition WHERE lev=$1 AND NOT ext=ANY(string_to_array($2, ',')) RETURNING etag, ext")
 	dao.Prepare("inst_usr", "INSERT INTO res_user_img (uid, filename, etag, ctime) VALUES ($1, $2, $3, $4)")
 	dao.Prepare("updt_usr", "UPDATE res_user_img SET etag=$3 WHERE uid=$1 AND filename=$2 AND rtime=0")
+	dao.Prepare("undated", "SELECT u.id, t.etag, t.ext, t.archived FROM res_user_img u JOIN res_thumb t ON t.etag=u.etag WHERE u.ctime=0")
+	dao.Prepare("date_usr", "UPDATE res_user_img SET ctime=$2 WHERE id=$1 AND ctime=0")
+	// REGEN
+	dao.Prepare("regen_list", "SELECT t.etag, t.ext"+regenWhere+" AND t.etag>$5 ORDER BY t.etag LIMIT $6")
+	dao.Prepare("regen_count", "SELECT count(*)"+regenWhere)
+	dao.Prepare("regen_done", "SELECT count(*)"+regenWhere+" AND t.etag<=$5")
+	// CACHE
+	dao.Prepare("touch_rendition", "UPDATE res_rendition SET atime=$4 WHERE etag=$1 AND lev=$2 AND ext=$3 AND atime<$5")
+	dao.Prepare("cache_size", "SELECT COALESCE(sum(size), 0) FROM res_rendition")
+	dao.Prepare("lru_renditions", "SELECT etag, lev, sum(size), max(atime) FROM res_rendition WHERE lev NOT IN ('raw', 'motion') GROUP BY etag, lev ORDER BY max(atime), etag LIMIT $1")
+	dao.Prepare("evict_rendition", "DELETE FROM res_rendition WHERE etag=$1 AND lev=$2"+
+		" AND NOT EXISTS (SELECT 1 FROM res_rendition WHERE etag=$1 AND lev=$2 AND $3<atime) RETURNING ext")
+	dao.Prepare("drop_rendition", "DELETE FROM res_rendition WHERE etag=$1 AND lev=$2 AND ext=$3")
+	// JOB
+	// a job is shared by the users of the etag
+	dao.Prepare("job", "SELECT "+jobColumns+" FROM res_job WHERE id=$1"+
+		" AND (uid=$2 OR etag IN (SELECT etag FROM res_user_img WHERE uid=$2 AND rtime=0))")
+	dao.Prepare("job_pending", "SELECT "+jobColumns+" FROM res_job WHERE etag=$1 AND status IN ('pending', 'running')")
+	dao.Prepare("job_last", "SELECT "+jobColumns+" FROM res_job WHERE uid=$1 AND etag=$2 ORDER BY ctime DESC, id DESC LIMIT 1")
+	dao.Prepare("inst_job", "INSERT INTO res_job (id, uid, etag, ctime, mtime) VALUES ($1, $2, $3, $4, $4)"+
+		" ON CONFLICT (etag) WHERE status IN ('pending', 'running') DO NOTHING RETURNING "+jobColumns)
+	dao.Prepare("claim_job", "UPDATE res_job SET status='running', attempts=attempts+1, mtime=$1"+
+		" WHERE id=(SELECT id FROM res_job WHERE status='pending' AND next_time<=$1 ORDER BY ctime LIMIT 1 FOR UPDATE SKIP LOCKED)"+
+		" RETURNING "+jobColumns)
+	dao.Prepare("retry_job", "UPDATE res_job SET status='pending', err=$2, mtime=$3, next_time=$4 WHERE id=$1")
+	dao.Prepare("done_job", "UPDATE res_job SET status=$2, err=$3, mtime=$4 WHERE id=$1")
+	dao.Prepare("reset_jobs", "UPDATE res_job SET status='pending' WHERE status='running' AND mtime<$1")
 
-	return &DBI{DAO: *dao}
+	return &DBI{DAO: *dao, db: dbConn}
 }
 
 func (dbi *DBI) Info(uid, fileName string) (string, error) {
@@ -48,69 +147,281 @@ func (dbi *DBI) Info(uid, fileName string) (string, error) {
 	return eTag, err
 }
 
-func (dbi *DBI) selectList(uid string, rangeList []helper.Segment) (rows *sql.Rows, err error) {
-	offset := int32(0)
-	length := int32(0)
+func scanFileMeta(row *sql.Row) (*FileMeta, error) {
+	meta := &FileMeta{}
+	err := row.Scan(&meta.Name, &meta.Ext, &meta.Hash, &meta.Size, &meta.CType)
+	if nil != err {
+		return nil, err
+	}
+	return meta, nil
+}
 
-	if nil != rangeList {
-		if 1 < len(rangeList) {
-			return nil, errors.New("multipart is not be allowed")
-		}
-		sep := rangeList[0]
-		offset = sep.Start
-		if -1 != sep.End {
-			length = sep.End - sep.Start
-		}
+func (dbi *DBI) Original(eTag string) (*FileMeta, error) {
+	meta := &FileMeta{}
+	err := dbi.StmtMap["original"].QueryRow(eTag).Scan(
+		&meta.Name, &meta.Ext, &meta.Hash, &meta.Size, &meta.CType, &meta.Unrenderable, &meta.Archived,
+	)
+	if nil != err {
+		return nil, err
 	}
-	if length < 1 {
-		return dbi.StmtMap["list"].Query(uid, offset)
+	return meta, nil
+}
+
+func (dbi *DBI) SetBlurHash(eTag, blurHash string) error {
+	_, err := dbi.StmtMap["blurhash"].Exec(eTag, blurHash)
+	return err
+}
+
+func (dbi *DBI) SetAnimated(eTag string, animated bool) error {
+	_, err := dbi.StmtMap["animated"].Exec(eTag, animated)
+	return err
+}
+
+func (dbi *DBI) SetArchived(eTag string, archived bool) error {
+	_, err := dbi.StmtMap["archived"].Exec(eTag, archived)
+	return err
+}
+
+/**
+ * an original out of the decode limits is not tried again till regenerated
+ */
+func (dbi *DBI) SetUnrenderable(eTag string, unrenderable bool) error {
+	_, err := dbi.StmtMap["unrenderable"].Exec(eTag, unrenderable)
+	return err
+}
+
+func (dbi *DBI) Rendition(eTag, lev, extName string) (*FileMeta, error) {
+	meta := &FileMeta{}
+	err := dbi.StmtMap["rendition"].QueryRow(eTag, lev, extName).Scan(
+		&meta.Name, &meta.Ext, &meta.Hash, &meta.Size, &meta.CType, &meta.Stale, &meta.Crop,
+	)
+	if nil != err {
+		return nil, err
 	}
-	return dbi.StmtMap["list_limit"].Query(uid, offset, length)
+	return meta, nil
 }
 
-func (dbi *DBI) List(uid string, rangeList []helper.Segment) ([]ResUserImg, error) {
-	rows, err := dbi.selectList(uid, rangeList)
+/**
+ * every encoding of the lev
+ */
+func (dbi *DBI) Renditions(eTag, lev string) ([]*FileMeta, error) {
+	rows, err := dbi.StmtMap["renditions"].Query(eTag, lev)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*FileMeta, 0)
+	for rows.Next() {
+		meta := &FileMeta{}
+		err = rows.Scan(&meta.Name, &meta.Ext, &meta.Hash, &meta.Size, &meta.CType, &meta.Stale, &meta.Crop)
+		if nil != err {
+			return nil, err
+		}
+		list = append(list, meta)
+	}
+	return list, rows.Err()
+}
+
+/**
+ * the motion part the user paired with the still
+ */
+func (dbi *DBI) Motion(uid, eTag string) (*FileMeta, error) {
+	return scanFileMeta(dbi.StmtMap["motion"].QueryRow(eTag, uid))
+}
+
+/**
+ * the motion part the user uploaded by the content identifier
+ */
+func (dbi *DBI) MotionByCId(uid, cid string) (*FileMeta, error) {
+	return scanFileMeta(dbi.StmtMap["motion_cid"].QueryRow(uid, cid))
+}
+
+/**
+ * offset and length of the single range, 0 length for no limit
+ */
+func pageOf(rangeList []helper.Segment) (offset, length int64, err error) {
+	if nil == rangeList {
+		return 0, 0, nil
+	}
+	if 1 < len(rangeList) {
+		return 0, 0, errors.New("multipart is not be allowed")
+	}
+	sep := rangeList[0]
+	offset = sep.Start
+	if offset < 0 {
+		offset = 0
+		length = -sep.Start
+	} else if -1 != sep.End {
+		length = sep.End - sep.Start
+	}
+	return offset, length, nil
+}
 
+func (dbi *DBI) selectList(uid string, rangeList []helper.Segment) (rows *sql.Rows, err error) {
+	offset, length, err := pageOf(rangeList)
 	if nil != err {
 		return nil, err
 	}
+	if length < 1 {
+		return dbi.StmtMap["list"].Query(uid, offset)
+	}
+	return dbi.StmtMap["list_limit"].Query(uid, offset, length)
+}
 
+func scanList(rows *sql.Rows) ([]ResUserImg, error) {
 	list := make([]ResUserImg, 0)
 	for rows.Next() {
-		var filename, eTag string
+		var filename, eTag, levs, blurHash, palette string
 		var cTime int64
+		var animated bool
 
-		err = rows.Scan(&filename, &eTag, &cTime)
+		err := rows.Scan(&filename, &eTag, &cTime, &levs, &blurHash, &palette, &animated)
 		if nil != err {
 			return nil, err
 		}
-		list = append(list, ResUserImg{
+		item := ResUserImg{
 			Filename: filename,
 			ETag:     eTag,
 			CTime:    cTime,
-		})
+			Levs:     []string{},
+			BlurHash: blurHash,
+			Palette:  []string{},
+			Animated: animated,
+		}
+		if "" != levs {
+			item.Levs = strings.Split(levs, ",")
+		}
+		if "" != palette {
+			item.Palette = strings.Split(palette, ",")
+		}
+		list = append(list, item)
 	}
-	return list, nil
+	return list, rows.Err()
 }
 
-func (dbi *DBI) Insert(uid, eTag, hash, filename string, siz, cTime int64) error {
-	extName := path.Ext(filename)
-	_, err := dbi.StmtMap["inst"].Exec(eTag, hash, extName, siz)
+func (dbi *DBI) List(uid string, rangeList []helper.Segment) ([]ResUserImg, error) {
+	rows, err := dbi.selectList(uid, rangeList)
+
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanList(rows)
+}
+
+func (dbi *DBI) insertThumb(thumb *ResThumb) error {
+	_, err := dbi.StmtMap["inst"].Exec(
+		thumb.ETag, thumb.Hash, thumb.Ext, thumb.Size, thumb.CType, thumb.CId,
+		thumb.Width, thumb.Height, thumb.Duration,
+	)
+	return err
+}
+
+func (dbi *DBI) Insert(uid, filename string, thumb *ResThumb, cTime int64) error {
+	err := dbi.insertThumb(thumb)
 	if nil == err {
-		_, err = dbi.StmtMap["inst_usr"].Exec(uid, filename, eTag, cTime)
+		_, err = dbi.StmtMap["inst_usr"].Exec(uid, filename, thumb.ETag, cTime)
 	}
 	return err
 }
 
-func (dbi *DBI) Update(uid, eTag, hash, filename string, siz int64) error {
-	extName := path.Ext(filename)
-	_, err := dbi.StmtMap["inst"].Exec(eTag, hash, extName, siz)
+func (dbi *DBI) Update(uid, filename string, thumb *ResThumb) error {
+	err := dbi.insertThumb(thumb)
 	if nil == err {
-		_, err = dbi.StmtMap["updt_usr"].Exec(uid, filename, eTag)
+		_, err = dbi.StmtMap["updt_usr"].Exec(uid, filename, thumb.ETag)
 	}
 	return err
 }
 
+/**
+ * uploads recorded without the time of creation, with their originals
+ */
+func (dbi *DBI) Undated() ([]int64, []*FileMeta, error) {
+	rows, err := dbi.StmtMap["undated"].Query()
+	if nil != err {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	ids, list := make([]int64, 0), make([]*FileMeta, 0)
+	for rows.Next() {
+		var id int64
+		file := &FileMeta{}
+		err = rows.Scan(&id, &file.Name, &file.Ext, &file.Archived)
+		if nil != err {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		list = append(list, file)
+	}
+	return ids, list, rows.Err()
+}
+
+func (dbi *DBI) SetCTime(id, cTime int64) error {
+	_, err := dbi.StmtMap["date_usr"].Exec(id, cTime)
+	return err
+}
+
+func (dbi *DBI) InsertMotion(uid, cid string, motion *FileMeta) error {
+	_, err := dbi.StmtMap["inst_motion"].Exec(motion.Name, uid, cid, motion.Hash, motion.Ext, motion.Size, motion.CType)
+	return err
+}
+
+func (dbi *DBI) UpdateMotion(uid, cid string, motion *FileMeta) error {
+	_, err := dbi.StmtMap["updt_motion"].Exec(motion.Name, uid, cid, motion.Hash, motion.Ext, motion.Size, motion.CType)
+	return err
+}
+
+/**
+ * the rendition is named by the etag of the original, sig is of the settings generated it
+ */
+func (dbi *DBI) InsertRendition(lev, sig string, rendition *FileMeta) error {
+	_, err := dbi.StmtMap["inst_rendition"].Exec(
+		rendition.Name, lev, rendition.Ext, rendition.Hash, rendition.Size, rendition.CType, sig, rendition.Crop,
+		time.Now().Unix(),
+	)
+	return err
+}
+
+/**
+ * renditions of the lev generated by other settings than sig, to regenerate.
+ * stillSig differs from sig by the animated flag only, the same to the renditions of a still
+ */
+func (dbi *DBI) MarkStale(lev, sig, stillSig string) (int64, error) {
+	res, err := dbi.StmtMap["stale_rendition"].Exec(lev, sig, stillSig)
+	if nil != err {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+/**
+ * renditions of the lev in the encodings other than exts, never to be regenerated. Nothing for no exts
+ * @return the etag and ext of each, to remove the files
+ */
+func (dbi *DBI) DropEncodings(lev string, exts []string) ([]*FileMeta, error) {
+	if 0 == len(exts) {
+		return []*FileMeta{}, nil
+	}
+	rows, err := dbi.StmtMap["drop_encodings"].Query(lev, strings.Join(exts, ","))
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*FileMeta, 0)
+	for rows.Next() {
+		file := &FileMeta{}
+		err = rows.Scan(&file.Name, &file.Ext)
+		if nil != err {
+			return nil, err
+		}
+		list = append(list, file)
+	}
+	return list, rows.Err()
+}
+
 func (dbi *DBI) Del(uid, filename string) error {
 	_, err := dbi.StmtMap["delt"].Exec(uid, filename, time.Now().Unix())
 	return err
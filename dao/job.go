@@ -0,0 +1,84 @@
+package dao
+
+import (
+	"database/sql"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// generating the renditions of an original in the background
+type Job struct {
+	Id       string
+	ETag     string
+	Status   string
+	Attempts int
+	Err      string
+	CTime    int64
+	MTime    int64
+}
+
+const jobColumns = "id, etag, status, attempts, err, ctime, mtime"
+
+func scanJob(row *sql.Row) (*Job, error) {
+	job := &Job{}
+	err := row.Scan(&job.Id, &job.ETag, &job.Status, &job.Attempts, &job.Err, &job.CTime, &job.MTime)
+	if nil != err {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (dbi *DBI) Job(uid, id string) (*Job, error) {
+	return scanJob(dbi.StmtMap["job"].QueryRow(id, uid))
+}
+
+/**
+ * the job of the etag not finished yet, whoever queued it
+ */
+func (dbi *DBI) PendingJob(eTag string) (*Job, error) {
+	return scanJob(dbi.StmtMap["job_pending"].QueryRow(eTag))
+}
+
+func (dbi *DBI) LastJob(uid, eTag string) (*Job, error) {
+	return scanJob(dbi.StmtMap["job_last"].QueryRow(uid, eTag))
+}
+
+/**
+ * sql.ErrNoRows when the etag has an unfinished job already
+ */
+func (dbi *DBI) InsertJob(id, uid, eTag string, cTime int64) (*Job, error) {
+	return scanJob(dbi.StmtMap["inst_job"].QueryRow(id, uid, eTag, cTime))
+}
+
+/**
+ * take the oldest pending job due by now, sql.ErrNoRows when there is none
+ */
+func (dbi *DBI) ClaimJob(now int64) (*Job, error) {
+	return scanJob(dbi.StmtMap["claim_job"].QueryRow(now))
+}
+
+func (dbi *DBI) RetryJob(id, msg string, now, nextTime int64) error {
+	_, err := dbi.StmtMap["retry_job"].Exec(id, msg, now, nextTime)
+	return err
+}
+
+func (dbi *DBI) FinishJob(id, status, msg string, now int64) error {
+	_, err := dbi.StmtMap["done_job"].Exec(id, status, msg, now)
+	return err
+}
+
+/**
+ * jobs running since before, left by a process gone, as a live one finishes its jobs by their deadline
+ */
+func (dbi *DBI) ResetJobs(before int64) (int64, error) {
+	res, err := dbi.StmtMap["reset_jobs"].Exec(before)
+	if nil != err {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
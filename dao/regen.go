@@ -0,0 +1,49 @@
+package dao
+
+// originals of the files not removed, filtered by user, extName and the time uploaded
+type RegenFilter struct {
+	Uid   string // empty for everyone
+	Ext   string // empty for any
+	Since int64
+	Until int64 // exclusive
+}
+
+const regenWhere = " FROM res_thumb t WHERE ($2='' OR lower(t.ext)=lower($2)) AND EXISTS (" +
+	"SELECT 1 FROM res_user_img u WHERE u.etag=t.etag AND u.rtime=0 AND ($1='' OR u.uid::text=$1) AND $3<=u.ctime AND u.ctime<$4)"
+
+func (dbi *DBI) RegenCount(filter *RegenFilter) (int64, error) {
+	count := int64(0)
+	err := dbi.StmtMap["regen_count"].QueryRow(filter.Uid, filter.Ext, filter.Since, filter.Until).Scan(&count)
+	return count, err
+}
+
+/**
+ * the originals up to the etag, done before a resume
+ */
+func (dbi *DBI) RegenDone(filter *RegenFilter, after string) (int64, error) {
+	count := int64(0)
+	err := dbi.StmtMap["regen_done"].QueryRow(filter.Uid, filter.Ext, filter.Since, filter.Until, after).Scan(&count)
+	return count, err
+}
+
+/**
+ * the next limit originals after the etag, in the order of etag
+ */
+func (dbi *DBI) RegenList(filter *RegenFilter, after string, limit int) ([]*FileMeta, error) {
+	rows, err := dbi.StmtMap["regen_list"].Query(filter.Uid, filter.Ext, filter.Since, filter.Until, after, limit)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*FileMeta, 0, limit)
+	for rows.Next() {
+		meta := &FileMeta{}
+		err = rows.Scan(&meta.Name, &meta.Ext)
+		if nil != err {
+			return nil, err
+		}
+		list = append(list, meta)
+	}
+	return list, rows.Err()
+}
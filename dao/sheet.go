@@ -0,0 +1,30 @@
+package dao
+
+// an asset on a sheet
+type SheetItem struct {
+	Filename string
+	ETag     string
+}
+
+/**
+ * the files of the user uploaded in [since, until) named after the album, oldest first, at most limit of them.
+ * An empty album takes every name
+ */
+func (dbi *DBI) SheetItems(uid, album string, since, until int64, limit int) ([]*SheetItem, error) {
+	rows, err := dbi.StmtMap["sheet_list"].Query(uid, since, until, limit, album)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*SheetItem, 0)
+	for rows.Next() {
+		item := &SheetItem{}
+		err = rows.Scan(&item.Filename, &item.ETag)
+		if nil != err {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	return list, rows.Err()
+}
@@ -5,9 +5,70 @@ GRANT ALL PRIVILEGES ON DATABASE res TO res;
 CREATE TABLE IF NOT EXISTS res_thumb (
     etag uuid PRIMARY KEY,
     hash char(64) UNIQUE,
-    ext char[16],
+    ext varchar(16),
     raw text UNIQUE,
-    size int DEFAULT 0
+    size bigint DEFAULT 0,
+    ctype varchar(64),
+    cid text,
+    width int DEFAULT 0,
+    height int DEFAULT 0,
+    duration int DEFAULT 0,
+    unrenderable boolean DEFAULT false,
+    blurhash varchar(64) DEFAULT '',
+    palette varchar(64) DEFAULT '',
+    animated boolean DEFAULT false,
+    archived boolean DEFAULT false
+);
+
+-- motion part of live photos, paired to res_thumb by cid
+CREATE TABLE IF NOT EXISTS res_motion (
+    etag uuid PRIMARY KEY,
+    uid uuid,
+    cid text,
+    hash char(64),
+    ext varchar(16),
+    size bigint DEFAULT 0,
+    ctype varchar(64),
+    UNIQUE (uid, cid)
+);
+
+-- generated files of each level, e.g. preview, thumb, in each encoding
+CREATE TABLE IF NOT EXISTS res_rendition (
+    etag uuid,
+    lev varchar(32),
+    ext varchar(16),
+    hash char(64),
+    size bigint DEFAULT 0,
+    ctype varchar(64),
+    sig varchar(64) DEFAULT '',
+    stale boolean DEFAULT false,
+    crop varchar(64) DEFAULT '',
+    atime bigint DEFAULT 0,
+    PRIMARY KEY (etag, lev, ext)
+);
+
+-- dominant colours of each picture in CIELAB, weight is the share of the pixels
+CREATE TABLE IF NOT EXISTS res_color (
+    etag uuid,
+    idx int,
+    l real,
+    a real,
+    b real,
+    weight real,
+    PRIMARY KEY (etag, idx)
+);
+
+-- background jobs generating the renditions, retried with backoff until next_time
+CREATE TABLE IF NOT EXISTS res_job (
+    id uuid PRIMARY KEY,
+    uid uuid,
+    etag uuid,
+    status varchar(16) DEFAULT 'pending',
+    attempts int DEFAULT 0,
+    err text DEFAULT '',
+    ctime bigint,
+    mtime bigint,
+    next_time bigint DEFAULT 0
 );
 
 CREATE TABLE IF NOT EXISTS res_user_img (
@@ -19,11 +80,42 @@ CREATE TABLE IF NOT EXISTS res_user_img (
     rtime int DEFAULT 0
 );
 
+-- upgrade res_thumb of the first db.sql in place, no-ops on a new one. Run the whole file again to migrate
+DO $$
+BEGIN
+    IF 'ARRAY' = (SELECT data_type FROM information_schema.columns WHERE table_name='res_thumb' AND column_name='ext') THEN
+        ALTER TABLE res_thumb ALTER COLUMN ext TYPE varchar(16) USING array_to_string(ext, '');
+    END IF;
+END $$;
+ALTER TABLE res_thumb ALTER COLUMN size TYPE bigint;
+ALTER TABLE res_thumb
+    ADD COLUMN IF NOT EXISTS ctype varchar(64),
+    ADD COLUMN IF NOT EXISTS cid text,
+    ADD COLUMN IF NOT EXISTS width int DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS height int DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS duration int DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS unrenderable boolean DEFAULT false,
+    ADD COLUMN IF NOT EXISTS blurhash varchar(64) DEFAULT '',
+    ADD COLUMN IF NOT EXISTS palette varchar(64) DEFAULT '',
+    ADD COLUMN IF NOT EXISTS animated boolean DEFAULT false,
+    ADD COLUMN IF NOT EXISTS archived boolean DEFAULT false;
+
 GRANT ALL PRIVILEGES ON TABLE res_thumb TO res;
+GRANT ALL PRIVILEGES ON TABLE res_motion TO res;
+GRANT ALL PRIVILEGES ON TABLE res_rendition TO res;
+GRANT ALL PRIVILEGES ON TABLE res_color TO res;
+GRANT ALL PRIVILEGES ON TABLE res_job TO res;
 GRANT ALL PRIVILEGES ON SEQUENCE res_user_img_id_seq TO res;
-CREATE INDEX res_uid_index ON res_user_img(uid);
-CREATE INDEX res_fn_index ON res_user_img(filename);
-CREATE INDEX res_ctime_index ON res_user_img(ctime);
-CREATE INDEX res_rtime_index ON res_user_img(rtime);
+CREATE INDEX IF NOT EXISTS res_uid_index ON res_user_img(uid);
+CREATE INDEX IF NOT EXISTS res_fn_index ON res_user_img(filename);
+CREATE INDEX IF NOT EXISTS res_ctime_index ON res_user_img(ctime);
+CREATE INDEX IF NOT EXISTS res_rtime_index ON res_user_img(rtime);
+CREATE INDEX IF NOT EXISTS res_cid_index ON res_thumb(cid);
+CREATE INDEX IF NOT EXISTS res_rendition_atime_index ON res_rendition(atime);
+CREATE INDEX IF NOT EXISTS res_color_lab_index ON res_color(l, a, b);
+CREATE INDEX IF NOT EXISTS res_job_status_index ON res_job(status, next_time);
+CREATE INDEX IF NOT EXISTS res_job_etag_index ON res_job(etag);
+-- one unfinished job an etag
+CREATE UNIQUE INDEX IF NOT EXISTS res_job_active_index ON res_job(etag) WHERE status IN ('pending', 'running');
 
 -- select floor(EXTRACT(epoch from ctime)) as ctime from res_thumb;
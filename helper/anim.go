@@ -0,0 +1,522 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/**
+ * bounds of an animated rendition, the frames past either are left out. 0 for no bound
+ */
+type AnimLimits struct {
+	MaxFrames   int
+	MaxDuration time.Duration
+}
+
+// browsers play the delays of 0 and 10ms at 100ms
+const animMinDelay = 20
+
+var (
+	DefaultAnimLimits = AnimLimits{MaxFrames: 300, MaxDuration: 30 * time.Second}
+	animLimits        = DefaultAnimLimits
+	// directory of img2webp and anim_dump of libwebp, $PATH when empty
+	webpTools string
+	// the frames after the limits
+	errAnimEnd = errors.New("animation limits reached")
+)
+
+func SetAnimLimits(l AnimLimits) {
+	animLimits = l
+}
+
+func SetWebPTools(dir string) {
+	webpTools = dir
+}
+
+/**
+ * an external tool in dir, or in $PATH when dir is empty
+ */
+func lookTool(dir, name string) (string, error) {
+	if "" == dir {
+		return exec.LookPath(name)
+	}
+	bin := path.Join(dir, name)
+	_, err := os.Stat(bin)
+	return bin, err
+}
+
+func webpTool(name string) (string, error) {
+	return lookTool(webpTools, name)
+}
+
+/**
+ * a gif of more than one image, or a webp with the animation flag of VP8X
+ */
+func IsAnimated(r io.ReaderAt) bool {
+	var head [21]byte
+	_, err := r.ReadAt(head[:], 0)
+	if nil != err {
+		return false
+	}
+	if "GIF8" == string(head[:4]) {
+		count, _ := gifFrames(io.NewSectionReader(r, 0, math.MaxInt64), 2)
+		return 1 < count
+	}
+	return isAnimatedWebP(r)
+}
+
+/**
+ * OpenCV refuses these, the frames are decoded by anim_dump
+ */
+func isAnimatedWebP(r io.ReaderAt) bool {
+	var head [21]byte
+	_, err := r.ReadAt(head[:], 0)
+	return nil == err && "RIFF" == string(head[:4]) && "WEBP" == string(head[8:12]) && "VP8X" == string(head[12:16]) && 0 != head[20]&0x02
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if nil != err || 0 == size {
+			return err
+		}
+		_, err = br.Discard(int(size))
+		if nil != err {
+			return err
+		}
+	}
+}
+
+/**
+ * walk the blocks of a gif up to max images, 0 for all of them
+ * @return the count and the offset after the last image
+ */
+func gifFrames(r io.Reader, max int) (int, int64) {
+	cr := &countReader{r: r}
+	br := bufio.NewReader(cr)
+	offset := func() int64 {
+		return cr.n - int64(br.Buffered())
+	}
+	var head [13]byte
+	_, err := io.ReadFull(br, head[:])
+	if nil != err || "GIF8" != string(head[:4]) {
+		return 0, 0
+	}
+	if 0 != head[10]&0x80 {
+		br.Discard(3 << (head[10]&7 + 1))
+	}
+	count, end := 0, int64(0)
+	for 0 == max || count < max {
+		b, err := br.ReadByte()
+		if nil != err {
+			break
+		}
+		switch b {
+		case 0x21:
+			// the label of the extension
+			_, err = br.ReadByte()
+		case 0x2c:
+			var desc [9]byte
+			_, err = io.ReadFull(br, desc[:])
+			if nil == err && 0 != desc[8]&0x80 {
+				_, err = br.Discard(3 << (desc[8]&7 + 1))
+			}
+			if nil == err {
+				// LZW minimum code size
+				_, err = br.ReadByte()
+			}
+		default:
+			// the trailer, or broken
+			return count, end
+		}
+		if nil == err {
+			err = skipSubBlocks(br)
+		}
+		if nil != err {
+			break
+		}
+		if 0x2c == b {
+			count++
+			end = offset()
+		}
+	}
+	return count, end
+}
+
+func animDelay(ms int) int {
+	if ms < animMinDelay {
+		return 100
+	}
+	return ms
+}
+
+func rgbaToMat(img *image.RGBA) (gocv.Mat, error) {
+	rgba, err := gocv.NewMatFromBytes(img.Rect.Dy(), img.Rect.Dx(), gocv.MatTypeCV8UC4, img.Pix)
+	if nil != err {
+		return rgba, err
+	}
+	defer rgba.Close()
+	mat := gocv.NewMat()
+	gocv.CvtColor(rgba, &mat, gocv.ColorBGRAToRGBA)
+	return mat, nil
+}
+
+/**
+ * compose the images of a gif onto the canvas by their disposal.
+ * Only the images within the limits are decoded, the stream is cut after them
+ */
+func eachGIFFrame(absPath string, fn func(frame *gocv.Mat, delay int) error) error {
+	fp, err := os.Open(absPath)
+	if nil != err {
+		return err
+	}
+	defer fp.Close()
+
+	_, end := gifFrames(fp, animLimits.MaxFrames)
+	g, err := gif.DecodeAll(io.MultiReader(io.NewSectionReader(fp, 0, end), bytes.NewReader([]byte{0x3b})))
+	if nil != err {
+		return err
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	var previous []byte
+	for i, img := range g.Image {
+		disposal := g.Disposal[i]
+		if gif.DisposalPrevious == disposal {
+			previous = append(previous[:0], canvas.Pix...)
+		}
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+		mat, err := rgbaToMat(canvas)
+		if nil != err {
+			return err
+		}
+		err = fn(&mat, animDelay(g.Delay[i]*10))
+		mat.Close()
+		if nil != err {
+			return err
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		default:
+		}
+	}
+	return nil
+}
+
+/**
+ * the durations of the ANMF chunks, in ms
+ */
+func webpDelays(r io.ReaderAt) ([]int, error) {
+	var head [16]byte
+	delays := make([]int, 0)
+	for offset := int64(12); ; {
+		_, err := r.ReadAt(head[:8], offset)
+		if io.EOF == err {
+			return delays, nil
+		}
+		if nil != err {
+			return nil, err
+		}
+		size := int64(binary.LittleEndian.Uint32(head[4:8]))
+		if "ANMF" == string(head[:4]) {
+			_, err = r.ReadAt(head[:], offset+8)
+			if nil != err {
+				return nil, err
+			}
+			delays = append(delays, animDelay(int(head[12])|int(head[13])<<8|int(head[14])<<16))
+		}
+		// padded to even
+		offset += 8 + size + size&1
+	}
+}
+
+/**
+ * the count of the leading frames within the limits, 1 at least
+ */
+func animFrames(delays []int) int {
+	count := len(delays)
+	if 0 < animLimits.MaxFrames {
+		count = min(count, animLimits.MaxFrames)
+	}
+	total := 0
+	for i, delay := range delays[:count] {
+		total += delay
+		if 0 < animLimits.MaxDuration && 0 < i && animLimits.MaxDuration < time.Duration(total)*time.Millisecond {
+			return i
+		}
+	}
+	return max(count, 1)
+}
+
+/**
+ * copy the webp into dst with the first frames ANMF chunks only, the other chunks as they are
+ */
+func trimWebP(absPath, dst string, frames int) error {
+	src, err := os.Open(absPath)
+	if nil != err {
+		return err
+	}
+	defer src.Close()
+
+	var head [8]byte
+	sections := make([]io.Reader, 0)
+	count, total := 0, int64(4)
+	for offset := int64(12); ; {
+		_, err = src.ReadAt(head[:], offset)
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			return err
+		}
+		size := int64(binary.LittleEndian.Uint32(head[4:8]))
+		// padded to even
+		size = 8 + size + size&1
+		if "ANMF" != string(head[:4]) || count < frames {
+			sections = append(sections, io.NewSectionReader(src, offset, size))
+			total += size
+		}
+		if "ANMF" == string(head[:4]) {
+			count++
+		}
+		offset += size
+	}
+	if math.MaxUint32 < total {
+		return errors.New("broken webp")
+	}
+
+	fp, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if nil != err {
+		return err
+	}
+	defer fp.Close()
+	riff := []byte("RIFF\x00\x00\x00\x00WEBP")
+	binary.LittleEndian.PutUint32(riff[4:8], uint32(total))
+	_, err = io.Copy(fp, io.MultiReader(append([]io.Reader{bytes.NewReader(riff)}, sections...)...))
+	return err
+}
+
+/**
+ * the first frames full frames of an animated webp, dumped by anim_dump of libwebp into tmpDir
+ * @return the files in the order of the frames
+ */
+func dumpWebP(absPath, tmpDir string, frames int) ([]string, error) {
+	bin, err := webpTool("anim_dump")
+	if nil != err {
+		return nil, err
+	}
+	// anim_dump has no bound of its own, it is given the frames to dump only
+	trimmed := path.Join(tmpDir, "trimmed.webp")
+	err = trimWebP(absPath, trimmed, frames)
+	if nil != err {
+		return nil, err
+	}
+	dumpDir := path.Join(tmpDir, "dump")
+	err = os.Mkdir(dumpDir, 0700)
+	if nil == err {
+		err = runTool(bin, "-folder", dumpDir, "-prefix", "f_", trimmed)
+	}
+	os.Remove(trimmed)
+	if nil != err {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dumpDir)
+	if nil != err {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "f_") {
+			names = append(names, path.Join(dumpDir, entry.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+/**
+ * the first frame of an animated webp, upright already
+ */
+func readWebPFrame(absPath string) (*gocv.Mat, error) {
+	tmpDir, err := os.MkdirTemp("", "anim")
+	if nil != err {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	names, err := dumpWebP(absPath, tmpDir, 1)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(names) {
+		return nil, errors.New("no frame decoded")
+	}
+	mat := gocv.IMRead(names[0], gocv.IMReadColor)
+	if mat.Empty() {
+		mat.Close()
+		return nil, errors.New("load frame failed")
+	}
+	return &mat, nil
+}
+
+/**
+ * the full frames within the limits, with the durations of the ANMF chunks
+ */
+func eachWebPFrame(absPath, tmpDir string, fn func(frame *gocv.Mat, delay int) error) error {
+	fp, err := os.Open(absPath)
+	if nil != err {
+		return err
+	}
+	delays, err := webpDelays(fp)
+	fp.Close()
+	if nil != err {
+		return err
+	}
+	names, err := dumpWebP(absPath, tmpDir, animFrames(delays))
+	if nil != err {
+		return err
+	}
+	for i, fileName := range names {
+		delay := 100
+		if i < len(delays) {
+			delay = delays[i]
+		}
+		mat := gocv.IMRead(fileName, gocv.IMReadUnchanged)
+		if mat.Empty() {
+			mat.Close()
+			return errors.New("load frame failed " + path.Base(fileName))
+		}
+		err = fn(&mat, delay)
+		mat.Close()
+		os.Remove(fileName)
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * run a tool of libwebp or libjxl, bounded by the decode timeout
+ */
+func runTool(bin string, args ...string) error {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if 0 < limits.Timeout {
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+	}
+	defer cancel()
+	out, err := exec.CommandContext(ctx, bin, args...).CombinedOutput()
+	if nil != err {
+		return fmt.Errorf("%s: %s %s", path.Base(bin), err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+/**
+ * the animated webp of an animated gif or webp into dst, each frame cropped to the fractions of crop,
+ * resized to size and converted to sRGB by profile
+ */
+func genAnimation(absPath string, profile *colorProfile, crop string, size image.Point, dst string, quality int) error {
+	bin, err := webpTool("img2webp")
+	if nil != err {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp("", "anim")
+	if nil != err {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-loop", "0", "-lossy", "-q", strconv.Itoa(quality)}
+	count, total := 0, 0
+	fn := func(frame *gocv.Mat, delay int) error {
+		if 0 < animLimits.MaxFrames && animLimits.MaxFrames <= count {
+			return errAnimEnd
+		}
+		if 0 < animLimits.MaxDuration && 0 < count && animLimits.MaxDuration < time.Duration(total+delay)*time.Millisecond {
+			return errAnimEnd
+		}
+		src := frame.Region(parseCropBox(crop, frame.Cols(), frame.Rows()))
+		defer src.Close()
+		mat := gocv.NewMat()
+		defer mat.Close()
+		gocv.Resize(src, &mat, size, 0, 0, gocv.InterpolationArea)
+		if nil != profile {
+			profile.apply(&mat)
+		}
+		fileName := path.Join(tmpDir, fmt.Sprintf("%04d.png", count))
+		if !gocv.IMWrite(fileName, mat) {
+			return errors.New("save frame failed")
+		}
+		count++
+		total += delay
+		args = append(args, "-d", strconv.Itoa(delay), fileName)
+		return nil
+	}
+
+	fp, err := os.Open(absPath)
+	if nil != err {
+		return err
+	}
+	var head [4]byte
+	_, err = fp.ReadAt(head[:], 0)
+	fp.Close()
+	if nil != err {
+		return err
+	}
+	if "GIF8" == string(head[:]) {
+		err = eachGIFFrame(absPath, fn)
+	} else {
+		err = eachWebPFrame(absPath, tmpDir, fn)
+	}
+	if nil != err && errAnimEnd != err {
+		return err
+	}
+	if 0 == count {
+		return errors.New("no frame decoded")
+	}
+
+	// renamed into place, like writeRendition
+	uuid, err := GenUUIDStr()
+	if nil != err {
+		return err
+	}
+	tmp := path.Join(path.Dir(dst), "."+uuid+".webp")
+	err = runTool(bin, append(args, "-o", tmp)...)
+	if nil != err {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
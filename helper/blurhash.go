@@ -0,0 +1,128 @@
+package helper
+
+import (
+	"math"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	// long side the hash is computed at, the components are far coarser
+	blurHashSide = 32
+)
+
+func base83(sb *strings.Builder, value, length int) {
+	for i := length - 1; 0 <= i; i-- {
+		digit := value
+		for j := 0; j < i; j++ {
+			digit /= 83
+		}
+		sb.WriteByte(base83Chars[digit%83])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+/**
+ * BlurHash of an sRGB mat of 8 bits, BGR, BGRA or gray,
+ * with 4 components on the long side and 3 on the other. Empty for the other types
+ */
+func blurHash(mat *gocv.Mat) string {
+	sample, _ := resizeMat(mat, &Resize{Width: blurHashSide, Height: blurHashSide, Fit: "contain"})
+	defer sample.Close()
+	channels := sample.Channels()
+	switch sample.Type() {
+	case gocv.MatTypeCV8U:
+	case gocv.MatTypeCV8UC3:
+	case gocv.MatTypeCV8UC4:
+	default:
+		return ""
+	}
+	data, err := sample.DataPtrUint8()
+	width, height := sample.Cols(), sample.Rows()
+	if nil != err || len(data) < width*height*channels {
+		return ""
+	}
+	// linear rgb
+	pixels := make([][3]float64, width*height)
+	for i := range pixels {
+		p := data[i*channels:]
+		if 1 == channels {
+			v := srgbToLinear(p[0])
+			pixels[i] = [3]float64{v, v, v}
+			continue
+		}
+		pixels[i] = [3]float64{srgbToLinear(p[2]), srgbToLinear(p[1]), srgbToLinear(p[0])}
+	}
+	return encodeBlurHash(pixels, width, height)
+}
+
+func encodeBlurHash(pixels [][3]float64, width, height int) string {
+	nx, ny := 4, 3
+	if width < height {
+		nx, ny = 3, 4
+	}
+	factors := make([][3]float64, 0, nx*ny)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			norm := 2.0
+			if 0 == i && 0 == j {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					p := &pixels[y*width+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := norm / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	sb := &strings.Builder{}
+	base83(sb, (nx-1)+(ny-1)*9, 1)
+	maxAC := 0.0
+	for _, f := range factors[1:] {
+		maxAC = math.Max(maxAC, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+	}
+	quantMax := int(math.Max(0, math.Min(82, math.Floor(maxAC*166-0.5))))
+	maxValue := float64(quantMax+1) / 166
+	base83(sb, quantMax, 1)
+
+	dc := factors[0]
+	base83(sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		value := 0
+		for _, c := range f {
+			q := int(math.Max(0, math.Min(18, math.Floor(signPow(c/maxValue, 0.5)*9+9.5))))
+			value = value*19 + q
+		}
+		base83(sb, value, 2)
+	}
+	return sb.String()
+}
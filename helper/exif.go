@@ -0,0 +1,112 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+
+	libheif "github.com/strukturag/libheif-go"
+)
+
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "mif1": true, "msf1": true, "avif": true,
+}
+
+func IsHeif(fp *os.File) bool {
+	return heifBrands[FileBrand(fp)]
+}
+
+func readHeifExif(fileName string) ([]byte, error) {
+	ctx, err := libheif.NewContext()
+	if nil == err {
+		err = ctx.ReadFromFile(fileName)
+	}
+	if nil != err {
+		return nil, err
+	}
+	handle, err := ctx.GetPrimaryImageHandle()
+	if nil != err {
+		return nil, err
+	}
+	for _, id := range handle.GetMetadataBlockIDs("Exif") {
+		buf, err := handle.GetMetadata(id)
+		if nil != err || len(buf) < 4 {
+			continue
+		}
+		// leading 4 bytes are the offset to the tiff header
+		skip := 4 + int(binary.BigEndian.Uint32(buf[:4]))
+		if skip < len(buf) {
+			return buf[skip:], nil
+		}
+	}
+	return nil, errors.New("exif not found")
+}
+
+/**
+ * @return the tiff structured exif block of a jpeg or heif
+ */
+func ReadExif(fileName string) ([]byte, error) {
+	fp, err := os.Open(fileName)
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+
+	if IsJPEG(fp) {
+		return JPEGApp(fp, 0xe1, exifHeader)
+	}
+	if IsHeif(fp) {
+		return readHeifExif(fileName)
+	}
+	return nil, errors.New("exif not supported")
+}
+
+/**
+ * @return IFD0 and the Exif IFD
+ */
+func exifIFDs(tf *tiffFile, ifd0 uint32) ([]tiffEntry, []tiffEntry) {
+	list, _, err := tf.readIFD(ifd0)
+	if nil != err {
+		return nil, nil
+	}
+	entry := findEntry(list, tagExifIFD)
+	if nil == entry {
+		return list, nil
+	}
+	exif, _, err := tf.readIFD(tf.uint(entry))
+	if nil != err {
+		return list, nil
+	}
+	return list, exif
+}
+
+/**
+ * the apple maker note is an IFD led by "Apple iOS\0", offsets are relative to the note itself
+ */
+func appleMakerNote(exif []byte) ([]tiffEntry, *tiffFile) {
+	tf, ifd0, err := newTiff(bytes.NewReader(exif), 0)
+	if nil != err {
+		return nil, nil
+	}
+	_, exifIFD := exifIFDs(tf, ifd0)
+	entry := findEntry(exifIFD, tagMakerNote)
+	if nil == entry {
+		return nil, nil
+	}
+	note, err := tf.bytes(entry)
+	if nil != err || len(note) < 16 || !bytes.HasPrefix(note, []byte("Apple iOS\x00")) {
+		return nil, nil
+	}
+	order := byteOrder(note[12:14])
+	if nil == order {
+		return nil, nil
+	}
+	noteFile := &tiffFile{r: bytes.NewReader(note), base: 0, order: order}
+	list, _, err := noteFile.readIFD(14)
+	if nil != err {
+		return nil, nil
+	}
+	return list, noteFile
+}
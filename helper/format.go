@@ -0,0 +1,146 @@
+package helper
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	libheif "github.com/strukturag/libheif-go"
+	"gocv.io/x/gocv"
+)
+
+type format struct {
+	ext   string
+	cType string
+}
+
+// by preference of the server
+var formats = []format{
+	{".jxl", "image/jxl"},
+	{".avif", "image/avif"},
+	{".webp", "image/webp"},
+	{".jpg", "image/jpeg"},
+}
+
+func isFormat(ext string) bool {
+	for _, f := range formats {
+		if ext == f.ext {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * encodings renditions are generated in, jxl only when cjxl is found, avif only when libheif has an AV1 encoder
+ */
+func RenditionFormats() []string {
+	list := make([]string, 0, len(formats))
+	for _, f := range formats {
+		if ".avif" == f.ext && !libheif.HaveEncoderForFormat(libheif.CompressionAV1) {
+			continue
+		}
+		if ".jxl" == f.ext {
+			if _, err := jxlTool("cjxl"); nil != err {
+				continue
+			}
+		}
+		list = append(list, f.ext)
+	}
+	return list
+}
+
+/**
+ * @return media type to q value
+ */
+func parseAccept(header *http.Header) map[string]float64 {
+	accept := make(map[string]float64)
+	for _, item := range strings.Split(header.Get("Accept"), ",") {
+		params := strings.Split(item, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if "" == mediaType {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if 2 == len(kv) && "q" == kv[0] {
+				val, err := strconv.ParseFloat(kv[1], 64)
+				if nil == err {
+					q = val
+				}
+			}
+		}
+		accept[mediaType] = q
+	}
+	return accept
+}
+
+// pick one of the available extNames by Accept.
+// jxl, avif and webp have to be listed explicitly, since old clients send wildcards they can't honour,
+// jpeg is also fine with image/* or */*, and is the fallback when nothing is acceptable
+func NegotiateFormat(header *http.Header, available []string) string {
+	accept := parseAccept(header)
+	has := make(map[string]bool)
+	for _, ext := range available {
+		has[ext] = true
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, f := range formats {
+		if !has[f.ext] {
+			continue
+		}
+		q, ok := accept[f.cType]
+		if !ok && "image/jpeg" == f.cType {
+			q, ok = accept["image/*"]
+			if !ok {
+				q, ok = accept["*/*"]
+			}
+		}
+		if ok && bestQ < q {
+			best, bestQ = f.ext, q
+		}
+	}
+	if "" != best {
+		return best
+	}
+	if has[".jpg"] || 0 == len(available) {
+		return ".jpg"
+	}
+	return available[0]
+}
+
+func writeAvif(mat gocv.Mat, dst string, quality int) error {
+	img, err := mat.ToImage()
+	if nil != err {
+		return err
+	}
+	ctx, _, err := libheif.EncodeFromImage(img, libheif.CompressionAV1, libheif.SetEncoderQuality(quality))
+	if nil != err {
+		return err
+	}
+	return ctx.WriteToFile(dst)
+}
+
+func encodeFile(mat gocv.Mat, dst, ext string, quality int) error {
+	switch ext {
+	case ".avif":
+		return writeAvif(mat, dst, quality)
+	case ".jxl":
+		return writeJXL(mat, dst, quality)
+	case ".jpg":
+		if !gocv.IMWriteWithParams(dst, mat, []int{int(gocv.IMWriteJpegQuality), quality}) {
+			return errors.New("save image failed")
+		}
+	case ".webp":
+		if !gocv.IMWriteWithParams(dst, mat, []int{int(gocv.IMWriteWebpQuality), quality}) {
+			return errors.New("save image failed")
+		}
+	default:
+		return errors.New("unsupported format " + ext)
+	}
+	return nil
+}
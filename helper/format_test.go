@@ -0,0 +1,39 @@
+package helper
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	all := []string{".jxl", ".avif", ".webp", ".jpg"}
+	cases := []struct {
+		name      string
+		accept    string
+		available []string
+		want      string
+	}{
+		{"no accept", "", all, ".jpg"},
+		{"listed", "image/avif,image/webp,*/*;q=0.8", all, ".avif"},
+		{"jxl preferred by the server", "image/jxl,image/avif,image/webp", all, ".jxl"},
+		{"q ranks", "image/avif;q=0.5,image/webp;q=0.9", all, ".webp"},
+		{"q=0 refuses", "image/avif;q=0,image/webp", all, ".webp"},
+		{"image wildcard for jpeg only", "image/*", all, ".jpg"},
+		{"any wildcard for jpeg only", "*/*", all, ".jpg"},
+		{"jpeg refused by q=0", "image/webp;q=0.1,image/*;q=0", all, ".webp"},
+		{"explicit jpeg over wildcard", "image/jpeg;q=0.2,image/*;q=0.9", []string{".webp", ".jpg"}, ".jpg"},
+		{"nothing acceptable", "image/avif;q=0", all, ".jpg"},
+		{"not available", "image/jxl", []string{".webp", ".jpg"}, ".jpg"},
+		{"no jpeg to fall back", "text/html", []string{".webp", ".avif"}, ".webp"},
+		{"nothing available", "image/webp", nil, ".jpg"},
+		{"malformed q", "image/webp;q=abc", all, ".webp"},
+		{"case and spaces", " Image/WebP ; q=0.5 ", all, ".webp"},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		header.Set("Accept", c.accept)
+		if got := NegotiateFormat(&header, c.available); got != c.want {
+			t.Errorf("%s: got %s", c.name, got)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package helper
+
+import (
+	"errors"
+
+	libheif "github.com/strukturag/libheif-go"
+	"gocv.io/x/gocv"
+)
+
+/**
+ * decode the primary image of a heif, which is the one to show in a multi-image container.
+ * libheif applies irot/imir so the result is upright, depth and auxiliary images are not touched
+ */
+func ReadHeif(fileName string) (*gocv.Mat, error) {
+	ctx, err := libheif.NewContext()
+	if nil == err {
+		err = ctx.ReadFromFile(fileName)
+	}
+	if nil != err {
+		return nil, err
+	}
+	handle, err := ctx.GetPrimaryImageHandle()
+	if nil != err {
+		return nil, err
+	}
+	opts, err := libheif.NewDecodingOptions()
+	if nil != err {
+		return nil, err
+	}
+	opts.SetConvertHDRTo8Bit(true)
+
+	chroma, channels, matType, code := libheif.ChromaInterleavedRGB, 3, gocv.MatTypeCV8UC3, gocv.ColorBGRToRGB
+	if handle.HasAlphaChannel() {
+		chroma, channels, matType, code = libheif.ChromaInterleavedRGBA, 4, gocv.MatTypeCV8UC4, gocv.ColorBGRAToRGBA
+	}
+	img, err := handle.DecodeImage(libheif.ColorspaceRGB, chroma, opts)
+	if nil != err {
+		return nil, err
+	}
+	plane, err := img.GetPlane(libheif.ChannelInterleaved)
+	if nil != err {
+		return nil, err
+	}
+	width := img.GetWidth(libheif.ChannelInterleaved)
+	height := img.GetHeight(libheif.ChannelInterleaved)
+	rowSize := width * channels
+	if width < 1 || height < 1 || plane.Stride < rowSize || len(plane.Plane) < plane.Stride*(height-1)+rowSize {
+		return nil, errors.New("broken heif image")
+	}
+
+	// rows may be padded to the stride
+	buf := make([]byte, rowSize*height)
+	for y := 0; y < height; y++ {
+		copy(buf[y*rowSize:(y+1)*rowSize], plane.Plane[y*plane.Stride:])
+	}
+	rgb, err := gocv.NewMatFromBytes(height, width, matType, buf)
+	if nil != err {
+		return nil, err
+	}
+	defer rgb.Close()
+
+	mat := gocv.NewMat()
+	gocv.CvtColor(rgb, &mat, code)
+	return &mat, nil
+}
@@ -4,12 +4,15 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"image"
 	"io"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,8 +20,17 @@ import (
 	"github.com/google/uuid"
 	"github.com/watsonserve/goengine"
 	"github.com/watsonserve/imghelper"
+	"gocv.io/x/gocv"
 )
 
+func init() {
+	mime.AddExtensionType(".mp4", "video/mp4")
+	mime.AddExtensionType(".mov", "video/quicktime")
+	mime.AddExtensionType(".heic", "image/heic")
+	mime.AddExtensionType(".heif", "image/heif")
+	mime.AddExtensionType(".jxl", "image/jxl")
+}
+
 func GenUUIDStr() (string, error) {
 	var buf [32]byte
 	__uuid, err := uuid.NewV7()
@@ -79,6 +91,7 @@ func CreateNewFile(dir, ext, digest string, src io.Reader) (string, int64, int64
 		if hash != digest {
 			err = errors.New("Digest Not Match")
 		}
+		cTime = time.Now().Unix()
 		break
 	}
 
@@ -129,13 +142,24 @@ func GetContentLength(header *http.Header) int64 {
 }
 
 type Segment struct {
-	Start int32
-	End   int32
+	Start int64 // negative for the suffix length
+	End   int64 // inclusive, -1 for infinity
 }
 
+// a decimal without a sign
+func parseRangePos(val string) (int64, error) {
+	if "" == val || '+' == val[0] || '-' == val[0] {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+/**
+ * bytes=200-1000, 2000-6576, 19000-, -500
+ * @return nil if absent or malformed
+ */
 func GetRange(header *http.Header) []Segment {
-	// bytes=200-1000, 2000-6576, 19000-
-	rangeVal := strings.Split(header.Get("Range"), "=")
+	rangeVal := strings.SplitN(header.Get("Range"), "=", 2)
 	if len(rangeVal) < 2 {
 		return nil
 	}
@@ -143,24 +167,72 @@ func GetRange(header *http.Header) []Segment {
 	results := make([]Segment, len(rangeList))
 
 	for i, seg := range rangeList {
-		sep := strings.Split(strings.TrimSpace(seg), "-")
-		offset, err := strconv.ParseInt(sep[0], 10, 32)
+		sep := strings.SplitN(strings.TrimSpace(seg), "-", 2)
+		if len(sep) < 2 {
+			return nil
+		}
+		// last n bytes
+		if "" == sep[0] {
+			suffix, err := parseRangePos(sep[1])
+			if nil != err || suffix < 1 {
+				return nil
+			}
+			results[i] = Segment{Start: -suffix, End: -1}
+			continue
+		}
+		offset, err := parseRangePos(sep[0])
 		if nil != err || offset < 0 {
-			offset = 0
+			return nil
 		}
-		end, err := strconv.ParseInt(sep[1], 10, 32)
-		if nil != err || end < offset {
-			end = -1 // infinity
+		end := int64(-1)
+		if "" != sep[1] {
+			end, err = parseRangePos(sep[1])
+			if nil != err || end < offset {
+				return nil
+			}
 		}
-		results[i] = Segment{Start: int32(offset), End: int32(end)}
+		results[i] = Segment{Start: offset, End: end}
 	}
 
 	return results
 }
 
+/**
+ * turn the ranges into absolute ones against the size, dropping the unsatisfiable
+ */
+func ResolveRange(rangeList []Segment, size int64) []Segment {
+	results := make([]Segment, 0, len(rangeList))
+	for _, seg := range rangeList {
+		if seg.Start < 0 {
+			if 0 == size {
+				continue
+			}
+			start := size + seg.Start
+			if start < 0 {
+				start = 0
+			}
+			results = append(results, Segment{Start: start, End: size - 1})
+			continue
+		}
+		if size <= seg.Start {
+			continue
+		}
+		end := seg.End
+		if end < 0 || size <= end {
+			end = size - 1
+		}
+		results = append(results, Segment{Start: seg.Start, End: end})
+	}
+	return results
+}
+
 func Sha256ByFile(fp *os.File) (string, error) {
+	return Sha256ByReader(fp)
+}
+
+func Sha256ByReader(src io.Reader) (string, error) {
 	hasher := sha256.New()
-	_, err := io.Copy(hasher, fp)
+	_, err := io.Copy(hasher, src)
 	if nil != err {
 		return "", err
 	}
@@ -168,7 +240,7 @@ func Sha256ByFile(fp *os.File) (string, error) {
 }
 
 type Meta struct {
-	Size        int32
+	Size        int64
 	ModTime     time.Time
 	ContentType string
 	Sha256Hash  string
@@ -185,7 +257,7 @@ func GetMeta(fp *os.File) (*Meta, error) {
 		return nil, err
 	}
 	return &Meta{
-		Size:        int32(stat.Size()),
+		Size:        stat.Size(),
 		ModTime:     stat.ModTime(),
 		ContentType: mime.TypeByExtension(path.Ext(stat.Name())),
 		Sha256Hash:  hash,
@@ -238,20 +310,19 @@ type ETag struct {
 	W     bool
 }
 
+/**
+ * "abc" or W/"abc", nil for * and the malformed
+ */
 func getMatchVal(eTag string) *ETag {
-	length := len(eTag)
-	if 0 == length {
-		return nil
-	}
-	ret := &ETag{Value: "", W: strings.HasPrefix(eTag, "W/\"")}
-	offset := 1
+	ret := &ETag{Value: "", W: strings.HasPrefix(eTag, "W/")}
 	if ret.W {
-		offset |= 2
+		eTag = eTag[2:]
 	}
-	ret.Value = eTag[offset : length-1]
-	if "" == ret.Value {
+	length := len(eTag)
+	if length < 3 || '"' != eTag[0] || '"' != eTag[length-1] {
 		return nil
 	}
+	ret.Value = eTag[1 : length-1]
 	return ret
 }
 
@@ -263,6 +334,38 @@ func GetNoneMatch(header *http.Header) *ETag {
 	return getMatchVal(header.Get("If-None-Match"))
 }
 
+/**
+ * @return false only when If-Modified-Since is present and not earlier than modTime
+ */
+func ModifiedSince(header *http.Header, modTime time.Time) bool {
+	val := header.Get("If-Modified-Since")
+	if "" == val {
+		return true
+	}
+	since, err := http.ParseTime(val)
+	if nil != err {
+		return true
+	}
+	return modTime.UTC().Truncate(time.Second).After(since)
+}
+
+/**
+ * If-Range carries either an entity tag or a http date
+ * @return whether the range request is still valid for the representation
+ */
+func CheckIfRange(header *http.Header, eTagVal string, modTime time.Time) bool {
+	val := strings.TrimSpace(header.Get("If-Range"))
+	if "" == val {
+		return true
+	}
+	if strings.HasSuffix(val, "\"") {
+		eTag := getMatchVal(val)
+		return nil != eTag && !eTag.W && eTag.Value == eTagVal
+	}
+	date, err := http.ParseTime(val)
+	return nil == err && date.Equal(modTime.UTC().Truncate(time.Second))
+}
+
 func GetFileName(pathName string) string {
 	length := len(pathName)
 	i := length - 1
@@ -281,20 +384,188 @@ func GetFileName(pathName string) string {
 	return pathName[i:]
 }
 
-func GenPreview(rootPath, baseName, extName string) error {
+/**
+ * decode the original upright, a jpeg shrunk on load to what the largest of sizes needs.
+ * Sniffed by the content since the extName of an upload is up to the client.
+ * libheif has applied the transformations of a heif, its EXIF Orientation must not be applied again
+ */
+func readSource(absPath string, sizes []Resize) (*gocv.Mat, error) {
+	fp, err := os.Open(absPath)
+	if nil != err {
+		return nil, err
+	}
+	brand := FileBrand(fp)
+	isRaw := IsRaw(fp)
+	isJXL := IsJXL(fp)
+	animWebP := isAnimatedWebP(fp)
+	err = checkSource(fp, brand, isRaw)
+	// the main image of a tiff based raw, decoded by OpenCV when there is no preview
+	rawErr := error(nil)
+	if isRaw {
+		rawErr = checkSize(imageSize(fp))
+	}
+	flag := gocv.IMReadColor
+	if IsJPEG(fp) {
+		width, height := jpegSize(fp)
+		flag = reduceFlag(width, height, sizes)
+	}
+	fp.Close()
+	if nil != err {
+		return nil, err
+	}
+
+	// falls back to the decoder when there is no preview
+	if isRaw {
+		mat, err := ReadRawPreview(absPath, sizes)
+		if nil == err {
+			return mat, nil
+		}
+		if nil != rawErr {
+			return nil, rawErr
+		}
+	}
+	switch {
+	case isJXL:
+		return ReadJXL(absPath)
+	case animWebP:
+		return readWebPFrame(absPath)
+	case heifBrands[brand]:
+		return ReadHeif(absPath)
+	case "" != brand && !isRaw:
+		return ReadPoster(absPath)
+	default:
+	}
+	var mat *gocv.Mat
+	if gocv.IMReadColor == flag {
+		mat, err = imghelper.IMRead(absPath)
+		if nil != err {
+			return nil, err
+		}
+	} else {
+		reduced := gocv.IMRead(absPath, flag|gocv.IMReadIgnoreOrientation)
+		if reduced.Empty() {
+			reduced.Close()
+			return nil, errors.New("load image failed")
+		}
+		mat = &reduced
+	}
+	// decoded unchanged or ignoring the orientation
+	exif, err := ReadExif(absPath)
+	if nil == err {
+		orient(mat, exifOrientation(exif))
+	}
+	return mat, nil
+}
+
+type Rendition struct {
+	Lev  string
+	Sig  string
+	Ext  string
+	Crop string // fractions "x,y,w,h" of the original, empty when not cropped
+	Meta
+}
+
+/**
+ * what GenPreview makes of an original
+ */
+type Preview struct {
+	List     []Rendition
+	BlurHash string
+	Palette  []Swatch
+	Animated bool
+}
+
+/**
+ * generate the renditions of the levels and the placeholders, in the worker process when there is one
+ */
+func GenPreview(rootPath, baseName, extName string, levels []Level) (*Preview, error) {
+	if 0 == len(workerCmd) {
+		return genPreview(rootPath, baseName, extName, levels)
+	}
+	res, err := callWorker(&workerRequest{Root: rootPath, BaseName: baseName, Ext: extName, Levels: levels})
+	if nil != err {
+		return nil, err
+	}
+	return &res.Preview, nil
+}
+
+func genPreview(rootPath, baseName, extName string, levels []Level) (*Preview, error) {
 	absPath := path.Join(rootPath, "raw", baseName+extName)
-	genFile := baseName + ".webp"
-	preview := path.Join(rootPath, "preview", genFile)
-	thumb := path.Join(rootPath, "thumb", genFile)
 
-	mat, err := imghelper.IMRead(absPath)
+	sizes := make([]Resize, len(levels))
+	for i := range levels {
+		sizes[i] = levels[i].Resize
+	}
+	mat, err := decodeSource(absPath, sizes)
 	if nil != err {
-		return err
+		return nil, err
+	}
+	defer mat.Close()
+
+	// largest first, each resized from the last uncropped one, which is still large enough
+	width, height := mat.Cols(), mat.Rows()
+	order := make([]int, len(levels))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return sizes[order[b]].scaleOf(width, height) < sizes[order[a]].scaleOf(width, height)
+	})
+
+	src, profile := mat, sourceProfile(absPath)
+	original := profile
+	animated := false
+	if fp, err := os.Open(absPath); nil == err {
+		animated = IsAnimated(fp)
+		fp.Close()
+	}
+	defer func() {
+		if src != mat {
+			src.Close()
+		}
+	}()
+	list := make([]Rendition, 0)
+	for _, i := range order {
+		level := &levels[i]
+		dst, items, err := genLevel(src, profile, path.Join(rootPath, level.Name), baseName, level.Name, &level.Resize, level.Exts())
+		if nil != err {
+			dst.Close()
+			return nil, err
+		}
+		for j := range items {
+			items[j].Sig = level.Sig()
+			if animated && level.Animated && ".webp" == items[j].Ext {
+				animate(absPath, original, &items[j], dst.Cols(), dst.Rows(), path.Join(rootPath, level.Name, baseName+".webp"), level.Resize.Quality)
+			}
+		}
+		list = append(list, items...)
+		if "contain" != level.Resize.Fit {
+			dst.Close()
+			continue
+		}
+		// converted to sRGB already
+		if src != mat {
+			src.Close()
+		}
+		src, profile = &dst, nil
 	}
+	sample := sampleOf(src, profile)
+	defer sample.Close()
+	return &Preview{List: list, BlurHash: blurHash(&sample), Palette: palette(&sample), Animated: animated}, nil
+}
 
-	err = imghelper.IMWrite(mat, preview, 64, 960)
+/**
+ * replace the still webp of the item by the animation, kept still when it fails, e.g. without img2webp
+ */
+func animate(absPath string, profile *colorProfile, item *Rendition, width, height int, dst string, quality int) {
+	err := genAnimation(absPath, profile, item.Crop, image.Pt(width, height), dst, quality)
 	if nil == err {
-		err = imghelper.IMWrite(mat, thumb, 50, 320)
+		var meta *Meta
+		meta, err = fileMetaOf(dst)
+		if nil == err {
+			item.Meta = *meta
+			return
+		}
 	}
-	return err
+	fmt.Fprintf(os.Stderr, "animate %s: %s\n", path.Base(absPath), err.Error())
 }
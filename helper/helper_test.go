@@ -0,0 +1,129 @@
+package helper
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetRange(t *testing.T) {
+	cases := []struct {
+		name  string
+		val   string
+		want  []Segment
+		valid bool
+	}{
+		{"absent", "", nil, false},
+		{"closed", "bytes=200-1000", []Segment{{200, 1000}}, true},
+		{"open-ended", "bytes=19000-", []Segment{{19000, -1}}, true},
+		{"suffix", "bytes=-500", []Segment{{-500, -1}}, true},
+		{"multiple", "bytes=0-99, 50-149,-10", []Segment{{0, 99}, {50, 149}, {-10, -1}}, true},
+		{"one byte", "bytes=0-0", []Segment{{0, 0}}, true},
+		{"reversed", "bytes=1000-200", nil, false},
+		{"zero suffix", "bytes=-0", nil, false},
+		{"no dash", "bytes=100", nil, false},
+		{"empty spec", "bytes=", nil, false},
+		{"empty part", "bytes=0-1,,2-3", nil, false},
+		{"both empty", "bytes=-", nil, false},
+		{"not a number", "bytes=a-b", nil, false},
+		{"negative", "bytes=-5-10", nil, false},
+		{"signed", "bytes=+5-10", nil, false},
+		{"no unit", "0-10", nil, false},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		header.Set("Range", c.val)
+		got := GetRange(&header)
+		if c.valid != (nil != got) || len(got) != len(c.want) {
+			t.Errorf("%s: got %v", c.name, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got %v", c.name, got)
+			}
+		}
+	}
+}
+
+func TestResolveRange(t *testing.T) {
+	cases := []struct {
+		name string
+		list []Segment
+		size int64
+		want []Segment
+	}{
+		{"closed", []Segment{{200, 1000}}, 10000, []Segment{{200, 1000}}},
+		{"past the end", []Segment{{200, 1000}}, 500, []Segment{{200, 499}}},
+		{"open-ended", []Segment{{100, -1}}, 500, []Segment{{100, 499}}},
+		{"suffix", []Segment{{-100, -1}}, 500, []Segment{{400, 499}}},
+		{"suffix over the size", []Segment{{-1000, -1}}, 500, []Segment{{0, 499}}},
+		{"suffix of nothing", []Segment{{-10, -1}}, 0, []Segment{}},
+		{"start at the size", []Segment{{500, -1}}, 500, []Segment{}},
+		{"overlapping kept", []Segment{{0, 299}, {100, 399}}, 500, []Segment{{0, 299}, {100, 399}}},
+		{"unsatisfiable dropped", []Segment{{600, 700}, {0, 9}}, 500, []Segment{{0, 9}}},
+	}
+	for _, c := range cases {
+		got := ResolveRange(c.list, c.size)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v", c.name, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got %v", c.name, got)
+			}
+		}
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 30, 15, 500000000, time.UTC)
+	cases := []struct {
+		name string
+		val  string
+		want bool
+	}{
+		{"absent", "", true},
+		{"strong match", `"abc"`, true},
+		{"strong mismatch", `"abd"`, false},
+		{"weak", `W/"abc"`, false},
+		{"bare quote", `"`, false},
+		{"empty tag", `""`, false},
+		{"date equal", "Wed, 01 May 2024 12:30:15 GMT", true},
+		{"date earlier", "Wed, 01 May 2024 12:30:14 GMT", false},
+		{"date later", "Wed, 01 May 2024 12:30:16 GMT", false},
+		{"malformed", "yesterday", false},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		header.Set("If-Range", c.val)
+		if got := CheckIfRange(&header, "abc", modTime); got != c.want {
+			t.Errorf("%s: got %v", c.name, got)
+		}
+	}
+}
+
+func TestGetNoneMatch(t *testing.T) {
+	cases := []struct {
+		val  string
+		want *ETag
+	}{
+		{"", nil},
+		{`"abc"`, &ETag{Value: "abc"}},
+		{`W/"abc"`, &ETag{Value: "abc", W: true}},
+		{"*", nil},
+		{`"`, nil},
+		{`W/"`, nil},
+		{`""`, nil},
+		{"abc", nil},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		header.Set("If-None-Match", c.val)
+		got := GetNoneMatch(&header)
+		if (nil == got) != (nil == c.want) || (nil != got && *got != *c.want) {
+			t.Errorf("%q: got %v", c.val, got)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"gocv.io/x/gocv"
+)
+
+/**
+ * a matrix/TRC rgb profile, as Adobe RGB and Display P3 are,
+ * converting to sRGB by linearizing, mapping the primaries, and encoding with the sRGB curve
+ */
+type colorProfile struct {
+	toLinear [3][256]float32
+	matrix   [3][3]float32 // linear rgb of the source to linear sRGB
+}
+
+const (
+	tagColorSpace     = 0xa001
+	tagInteropIFD     = 0xa005
+	tagInteropIndex   = 0x0001
+	srgbEncodeLUTSize = 4096
+)
+
+var (
+	iccHeader = []byte("ICC_PROFILE\x00")
+	// PCS XYZ, D50, to linear sRGB, Bradford adapted
+	xyzToSRGB = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+	// colorants of Adobe RGB (1998), D50 adapted, for the cameras tagging it in EXIF instead of embedding the profile
+	adobeRGBColorants = [3][3]float64{
+		{0.6097559, 0.3111065, 0.0194797},
+		{0.2052401, 0.6256560, 0.0608913},
+		{0.1492240, 0.0632275, 0.7448387},
+	}
+	srgbEncode = func() []uint8 {
+		lut := make([]uint8, srgbEncodeLUTSize)
+		for i := range lut {
+			v := float64(i) / (srgbEncodeLUTSize - 1)
+			if v <= 0.0031308 {
+				v *= 12.92
+			} else {
+				v = 1.055*math.Pow(v, 1/2.4) - 0.055
+			}
+			lut[i] = uint8(math.Round(v * 255))
+		}
+		return lut
+	}()
+)
+
+func s15Fixed16(buf []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(buf))) / 65536
+}
+
+/**
+ * tone curve of a curv or para tag
+ */
+func parseTRC(buf []byte) (func(float64) float64, error) {
+	if len(buf) < 12 {
+		return nil, errors.New("broken trc")
+	}
+	switch string(buf[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(buf[8:12]))
+		if len(buf) < 12+count*2 {
+			return nil, errors.New("broken curv")
+		}
+		switch count {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			g := float64(binary.BigEndian.Uint16(buf[12:14])) / 256
+			return func(v float64) float64 { return math.Pow(v, g) }, nil
+		default:
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(buf[12+i*2:])) / 65535
+		}
+		return func(v float64) float64 {
+			pos := v * float64(count-1)
+			if !(0 < pos) {
+				return table[0]
+			}
+			i := int(pos)
+			if count-1 <= i {
+				return table[count-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+	case "para":
+		fn := binary.BigEndian.Uint16(buf[8:10])
+		counts := []int{1, 3, 4, 5, 7}
+		if len(counts) <= int(fn) || len(buf) < 12+counts[fn]*4 {
+			return nil, errors.New("broken para")
+		}
+		// g, a, b, c, d, e, f
+		p := []float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < counts[fn]; i++ {
+			p[i] = s15Fixed16(buf[12+i*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		// the exponent, the slopes and the break point are never negative in a real profile
+		if g < 0 || a < 0 || c < 0 || d < 0 {
+			return nil, errors.New("broken para")
+		}
+		return func(v float64) float64 {
+			switch fn {
+			case 1:
+				if v < -b/a {
+					return 0
+				}
+				return math.Pow(a*v+b, g)
+			case 2:
+				if v < -b/a {
+					return c
+				}
+				return math.Pow(a*v+b, g) + c
+			case 3:
+				if v < d {
+					return c * v
+				}
+				return math.Pow(a*v+b, g)
+			case 4:
+				if v < d {
+					return c*v + f
+				}
+				return math.Pow(a*v+b, g) + e
+			default:
+			}
+			return math.Pow(v, g)
+		}, nil
+	default:
+	}
+	return nil, errors.New("unsupported trc " + string(buf[:4]))
+}
+
+func newColorProfile(colorants [3][3]float64, trc [3]func(float64) float64) *colorProfile {
+	p := &colorProfile{}
+	for c := 0; c < 3; c++ {
+		for i := 0; i < 256; i++ {
+			p.toLinear[c][i] = float32(trc[c](float64(i) / 255))
+		}
+	}
+	// colorants are the columns of rgb to XYZ
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			sum := 0.0
+			for k := 0; k < 3; k++ {
+				sum += xyzToSRGB[i][k] * colorants[j][k]
+			}
+			p.matrix[i][j] = float32(sum)
+		}
+	}
+	return p
+}
+
+/**
+ * only the matrix/TRC rgb profiles, LUT based ones are left as they are
+ */
+func parseICC(icc []byte) (*colorProfile, error) {
+	if len(icc) < 132 || "RGB " != string(icc[16:20]) || "XYZ " != string(icc[20:24]) {
+		return nil, errors.New("unsupported icc profile")
+	}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(icc[128:132]))
+	for i := 0; i < count && 132+i*12+12 <= len(icc); i++ {
+		entry := icc[132+i*12:]
+		offset := int(binary.BigEndian.Uint32(entry[4:8]))
+		siz := int(binary.BigEndian.Uint32(entry[8:12]))
+		if offset < 0 || siz < 0 || len(icc) < offset+siz {
+			return nil, errors.New("broken icc profile")
+		}
+		tags[string(entry[:4])] = icc[offset : offset+siz]
+	}
+
+	var colorants [3][3]float64
+	var trc [3]func(float64) float64
+	for c, name := range []string{"r", "g", "b"} {
+		xyz := tags[name+"XYZ"]
+		if len(xyz) < 20 || "XYZ " != string(xyz[:4]) {
+			return nil, errors.New("icc colorant not found")
+		}
+		for i := 0; i < 3; i++ {
+			colorants[c][i] = s15Fixed16(xyz[8+i*4:])
+		}
+		fn, err := parseTRC(tags[name+"TRC"])
+		if nil != err {
+			return nil, err
+		}
+		trc[c] = fn
+	}
+	return newColorProfile(colorants, trc), nil
+}
+
+/**
+ * an sRGB profile has nothing to convert
+ */
+func (p *colorProfile) isSRGB() bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			expect := float32(0)
+			if i == j {
+				expect = 1
+			}
+			if 0.01 < math.Abs(float64(p.matrix[i][j]-expect)) {
+				return false
+			}
+		}
+		for v := 0; v < 256; v++ {
+			if 1 < math.Abs(float64(encodeSRGB(p.toLinear[i][v]))-float64(v)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func adobeRGBProfile() *colorProfile {
+	gamma := func(v float64) float64 { return math.Pow(v, 563.0/256) }
+	return newColorProfile(adobeRGBColorants, [3]func(float64) float64{gamma, gamma, gamma})
+}
+
+/**
+ * convert a BGR or BGRA mat of 8 bits in place
+ */
+func (p *colorProfile) apply(mat *gocv.Mat) {
+	channels := mat.Channels()
+	if (gocv.MatTypeCV8UC3 != mat.Type() && gocv.MatTypeCV8UC4 != mat.Type()) || !mat.IsContinuous() {
+		return
+	}
+	data, err := mat.DataPtrUint8()
+	if nil != err {
+		return
+	}
+	m := &p.matrix
+	for i := 0; i+2 < len(data); i += channels {
+		b, g, r := p.toLinear[2][data[i]], p.toLinear[1][data[i+1]], p.toLinear[0][data[i+2]]
+		data[i] = encodeSRGB(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+		data[i+1] = encodeSRGB(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+		data[i+2] = encodeSRGB(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+	}
+}
+
+func encodeSRGB(v float32) uint8 {
+	// NaN as well
+	if !(0 < v) {
+		return 0
+	}
+	if 1 <= v {
+		return 255
+	}
+	return srgbEncode[int(v*(srgbEncodeLUTSize-1)+0.5)]
+}
+
+/**
+ * ICC profile split into the APP2 segments of a jpeg
+ */
+func jpegICC(r io.ReaderAt) []byte {
+	list, err := JPEGSegments(r)
+	if nil != err {
+		return nil
+	}
+	hLen := int64(len(iccHeader))
+	chunks := make(map[int][]byte)
+	for _, seg := range list {
+		if 0xe2 != seg.Marker || seg.Size < hLen+2 {
+			continue
+		}
+		buf := make([]byte, seg.Size)
+		_, err = r.ReadAt(buf, seg.Offset)
+		if nil != err || !bytes.Equal(iccHeader, buf[:hLen]) {
+			continue
+		}
+		// sequence number, from 1
+		chunks[int(buf[hLen])] = buf[hLen+2:]
+	}
+	if 0 == len(chunks) {
+		return nil
+	}
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	icc := make([]byte, 0)
+	for _, seq := range seqs {
+		icc = append(icc, chunks[seq]...)
+	}
+	return icc
+}
+
+/**
+ * restricted or unrestricted ICC of the colr property, the nclx ones carry no profile
+ */
+func heifICC(r io.ReaderAt) []byte {
+	ipco, err := FindBoxPath(r, 0, -1, "meta", "iprp", "ipco")
+	if nil != err {
+		return nil
+	}
+	list, err := ReadBoxes(r, ipco.Offset, ipco.Offset+ipco.Size)
+	if nil != err {
+		return nil
+	}
+	for i := range list {
+		if "colr" != list[i].Type {
+			continue
+		}
+		buf, err := ReadBox(r, &list[i])
+		if nil == err && 4 < len(buf) && ("prof" == string(buf[:4]) || "rICC" == string(buf[:4])) {
+			return buf[4:]
+		}
+	}
+	return nil
+}
+
+/**
+ * cameras set to Adobe RGB tag it by the DCF option file, R03, or a ColorSpace of 2
+ */
+func isAdobeRGB(r io.ReaderAt) bool {
+	tf, ifd0, err := newTiff(r, 0)
+	if nil != err {
+		return false
+	}
+	_, exif := exifIFDs(tf, ifd0)
+	if entry := findEntry(exif, tagColorSpace); nil != entry && 2 == tf.uint(entry) {
+		return true
+	}
+	entry := findEntry(exif, tagInteropIFD)
+	if nil == entry {
+		return false
+	}
+	list, _, err := tf.readIFD(tf.uint(entry))
+	if nil != err {
+		return false
+	}
+	entry = findEntry(list, tagInteropIndex)
+	return nil != entry && "R03" == tf.str(entry)
+}
+
+/**
+ * profile of the pixels readSource decodes, nil for sRGB or unknown
+ */
+func sourceProfile(fileName string) *colorProfile {
+	fp, err := os.Open(fileName)
+	if nil != err {
+		return nil
+	}
+	defer fp.Close()
+
+	var icc []byte
+	var exif io.ReaderAt
+	switch {
+	case IsJPEG(fp):
+		icc = jpegICC(fp)
+		buf, err := JPEGApp(fp, 0xe1, exifHeader)
+		if nil == err {
+			exif = bytes.NewReader(buf)
+		}
+	case heifBrands[FileBrand(fp)]:
+		icc = heifICC(fp)
+	case IsRaw(fp):
+		previews := rawPreviews(fp)
+		if 0 == len(previews) {
+			return nil
+		}
+		preview := io.NewSectionReader(fp, previews[0].offset, previews[0].size)
+		icc = jpegICC(preview)
+		if isTiffRaw(fp) {
+			exif = fp
+		} else if buf, err := JPEGApp(preview, 0xe1, exifHeader); nil == err {
+			exif = bytes.NewReader(buf)
+		}
+	default:
+	}
+
+	if nil != icc {
+		profile, err := parseICC(icc)
+		if nil != err || profile.isSRGB() {
+			return nil
+		}
+		return profile
+	}
+	if nil != exif && isAdobeRGB(exif) {
+		return adobeRGBProfile()
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package helper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// the payload of a box read into memory, the largest of mvhd, keys or stsz stays far below
+const maxBoxRead = 1 << 24
+
+type Box struct {
+	Type   string
+	Offset int64 // payload offset
+	Size   int64 // payload size
+}
+
+/**
+ * the size of a file or of an in-memory reader, -1 when unknown
+ */
+func readerSize(r io.ReaderAt) int64 {
+	switch v := r.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		stat, err := v.Stat()
+		if nil == err {
+			return stat.Size()
+		}
+	case interface{ Size() int64 }:
+		return v.Size()
+	default:
+	}
+	return -1
+}
+
+/**
+ * list the boxes laid between offset and end, end < 0 means up to EOF.
+ * No box may reach past the end of the file
+ */
+func ReadBoxes(r io.ReaderAt, offset, end int64) ([]Box, error) {
+	var head [16]byte
+	list := make([]Box, 0)
+	if fileSize := readerSize(r); 0 <= fileSize && (end < 0 || fileSize < end) {
+		end = fileSize
+	}
+
+	for end < 0 || offset+8 <= end {
+		_, err := r.ReadAt(head[:8], offset)
+		if io.EOF == err && end < 0 {
+			break
+		}
+		if nil != err {
+			return nil, err
+		}
+		siz := int64(binary.BigEndian.Uint32(head[:4]))
+		hLen := int64(8)
+		switch siz {
+		case 0:
+			// up to the end of container
+			if end < 0 {
+				return append(list, Box{Type: string(head[4:8]), Offset: offset + hLen, Size: -1}), nil
+			}
+			siz = end - offset
+		case 1:
+			_, err = r.ReadAt(head[8:16], offset+8)
+			if nil != err {
+				return nil, err
+			}
+			siz = int64(binary.BigEndian.Uint64(head[8:16]))
+			hLen = 16
+		}
+		if siz < hLen || (0 <= end && end-offset < siz) {
+			return nil, errors.New("broken box " + string(head[4:8]))
+		}
+		list = append(list, Box{Type: string(head[4:8]), Offset: offset + hLen, Size: siz - hLen})
+		offset += siz
+	}
+	return list, nil
+}
+
+func FindBox(list []Box, boxType string) *Box {
+	for i := range list {
+		if boxType == list[i].Type {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+/**
+ * walk down the box tree by types, e.g. "moov", "meta", "keys"
+ */
+func FindBoxPath(r io.ReaderAt, offset, end int64, boxPath ...string) (*Box, error) {
+	var box *Box
+	for _, boxType := range boxPath {
+		list, err := ReadBoxes(r, offset, end)
+		if nil != err {
+			return nil, err
+		}
+		box = FindBox(list, boxType)
+		if nil == box {
+			return nil, errors.New("box " + boxType + " not found")
+		}
+		offset, end = box.Offset, box.Offset+box.Size
+		// full box: version and flags
+		if "meta" == boxType && !isQuickTimeMeta(r, offset) {
+			offset += 4
+		}
+	}
+	return box, nil
+}
+
+// the meta box of QuickTime is a plain box, while ISO meta is a full box
+func isQuickTimeMeta(r io.ReaderAt, offset int64) bool {
+	var buf [8]byte
+	_, err := r.ReadAt(buf[:], offset)
+	return nil == err && "hdlr" == string(buf[4:8])
+}
+
+func ReadBox(r io.ReaderAt, box *Box) ([]byte, error) {
+	if nil == box || box.Size < 0 {
+		return nil, errors.New("unsized box")
+	}
+	if maxBoxRead < box.Size {
+		return nil, errors.New("box " + box.Type + " too large")
+	}
+	buf := make([]byte, box.Size)
+	_, err := r.ReadAt(buf, box.Offset)
+	return buf, err
+}
+
+/**
+ * @return major brand, empty when it is not an ISO base media file
+ */
+func FileBrand(r io.ReaderAt) string {
+	var head [12]byte
+	_, err := r.ReadAt(head[:], 0)
+	if nil != err || "ftyp" != string(head[4:8]) {
+		return ""
+	}
+	return string(head[8:12])
+}
@@ -0,0 +1,131 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func testBox(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	buf := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(8+len(body)))
+	copy(buf[4:], boxType)
+	return append(buf, body...)
+}
+
+// a box whose 64-bit size claims more than there is
+func testLargeBox(boxType string, size uint64, payload []byte) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf, 1)
+	copy(buf[4:], boxType)
+	binary.BigEndian.PutUint64(buf[8:], size)
+	return append(buf, payload...)
+}
+
+func testMvhd(version byte, timeScale uint32, duration uint64) []byte {
+	if 0 == version {
+		buf := make([]byte, 100)
+		binary.BigEndian.PutUint32(buf[12:], timeScale)
+		binary.BigEndian.PutUint32(buf[16:], uint32(duration))
+		return buf
+	}
+	buf := make([]byte, 112)
+	buf[0] = 1
+	binary.BigEndian.PutUint32(buf[20:], timeScale)
+	binary.BigEndian.PutUint64(buf[24:], duration)
+	return buf
+}
+
+func TestReadBoxes(t *testing.T) {
+	cases := []struct {
+		name  string
+		file  []byte
+		types []string
+		fail  bool
+	}{
+		{"plain", append(testBox("ftyp", []byte("isom")), testBox("moov")...), []string{"ftyp", "moov"}, false},
+		{"empty", nil, []string{}, false},
+		{"to the end", append(testBox("ftyp"), 0, 0, 0, 0, 'm', 'd', 'a', 't', 1, 2, 3), []string{"ftyp", "mdat"}, false},
+		{"past the file", append(testBox("ftyp"), 0, 0, 1, 0, 'm', 'o', 'o', 'v'), nil, true},
+		{"64-bit past the file", testLargeBox("moov", 1<<40, make([]byte, 16)), nil, true},
+		{"64-bit negative", testLargeBox("moov", 1<<63, make([]byte, 16)), nil, true},
+		{"under the header", []byte{0, 0, 0, 4, 'f', 'r', 'e', 'e'}, nil, true},
+	}
+	for _, c := range cases {
+		list, err := ReadBoxes(bytes.NewReader(c.file), 0, -1)
+		if c.fail {
+			if nil == err {
+				t.Errorf("%s: want an error, got %v", c.name, list)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("%s: %s", c.name, err.Error())
+			continue
+		}
+		if len(list) != len(c.types) {
+			t.Errorf("%s: got %v", c.name, list)
+			continue
+		}
+		for i, box := range list {
+			if c.types[i] != box.Type || int64(len(c.file)) < box.Offset+box.Size {
+				t.Errorf("%s: got %v", c.name, box)
+			}
+		}
+	}
+}
+
+func TestReadBox(t *testing.T) {
+	r := bytes.NewReader(testBox("free", []byte("abc")))
+	buf, err := ReadBox(r, &Box{Type: "free", Offset: 8, Size: 3})
+	if nil != err || "abc" != string(buf) {
+		t.Errorf("got %q %v", buf, err)
+	}
+	if _, err = ReadBox(r, &Box{Type: "stsz", Offset: 8, Size: 1 << 40}); nil == err {
+		t.Error("want an error for a box over the cap")
+	}
+	if _, err = ReadBox(r, nil); nil == err {
+		t.Error("want an error for no box")
+	}
+}
+
+func TestMvhdDuration(t *testing.T) {
+	cases := []struct {
+		buf      []byte
+		duration int64
+		fail     bool
+	}{
+		{testMvhd(0, 600, 1500), 2500, false},
+		{testMvhd(1, 90000, 90000*3600), 3600000, false},
+		{testMvhd(1, 1, 1<<63), 0, true},
+		{testMvhd(1, 0xffffffff, 1<<64-1), 4294967297000, false},
+		{testMvhd(0, 0, 10), 0, true},
+		{[]byte{0, 0, 0}, 0, true},
+		{nil, 0, true},
+	}
+	for i, c := range cases {
+		duration, err := mvhdDuration(c.buf)
+		if c.fail != (nil != err) || duration != c.duration {
+			t.Errorf("case %d: got %d %v", i, duration, err)
+		}
+	}
+}
+
+func TestReadVideoInfoHuge(t *testing.T) {
+	// a tiny upload whose mvhd claims gigabytes
+	file := append(testBox("ftyp", []byte("isom")), testLargeBox("moov", 16+8+8, testLargeBox("mvhd", 1<<32, nil)[:8])...)
+	if _, err := ReadVideoInfo(bytes.NewReader(file)); nil == err {
+		t.Error("want an error")
+	}
+}
+
+func FuzzReadVideoInfo(f *testing.F) {
+	f.Add(append(testBox("ftyp", []byte("isom")), testBox("moov", testBox("mvhd", testMvhd(0, 600, 1200)))...))
+	f.Add(testLargeBox("moov", 1<<40, testLargeBox("mvhd", 1<<40, nil)))
+	f.Fuzz(func(t *testing.T, file []byte) {
+		ReadVideoInfo(bytes.NewReader(file))
+		quickTimeContentId(bytes.NewReader(file))
+		cr3Previews(bytes.NewReader(file))
+	})
+}
@@ -0,0 +1,115 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+type JPEGSegment struct {
+	Marker byte
+	Offset int64 // payload offset
+	Size   int64 // payload size
+}
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+func IsJPEG(r io.ReaderAt) bool {
+	var soi [3]byte
+	_, err := r.ReadAt(soi[:], 0)
+	return nil == err && 0xff == soi[0] && 0xd8 == soi[1] && 0xff == soi[2]
+}
+
+/**
+ * list the marker segments of a jpeg until start of scan
+ */
+func JPEGSegments(r io.ReaderAt) ([]JPEGSegment, error) {
+	if !IsJPEG(r) {
+		return nil, errors.New("not a jpeg")
+	}
+	var head [4]byte
+	list := make([]JPEGSegment, 0)
+	offset := int64(2)
+
+	for {
+		_, err := r.ReadAt(head[:], offset)
+		if nil != err {
+			return nil, err
+		}
+		if 0xff != head[0] {
+			return nil, errors.New("broken jpeg marker")
+		}
+		marker := head[1]
+		// fill bytes
+		if 0xff == marker {
+			offset++
+			continue
+		}
+		// start of scan, end of image
+		if 0xda == marker || 0xd9 == marker {
+			break
+		}
+		siz := int64(binary.BigEndian.Uint16(head[2:4]))
+		if siz < 2 {
+			return nil, errors.New("broken jpeg segment")
+		}
+		list = append(list, JPEGSegment{Marker: marker, Offset: offset + 4, Size: siz - 2})
+		offset += 2 + siz
+	}
+	return list, nil
+}
+
+/**
+ * find the payload of the first APPn segment led by header
+ */
+func JPEGApp(r io.ReaderAt, marker byte, header []byte) ([]byte, error) {
+	list, err := JPEGSegments(r)
+	if nil != err {
+		return nil, err
+	}
+	hLen := int64(len(header))
+	for _, seg := range list {
+		if marker != seg.Marker || seg.Size < hLen {
+			continue
+		}
+		buf := make([]byte, seg.Size)
+		_, err = r.ReadAt(buf, seg.Offset)
+		if nil != err {
+			return nil, err
+		}
+		if bytes.Equal(header, buf[:hLen]) {
+			return buf[hLen:], nil
+		}
+	}
+	return nil, errors.New("segment not found")
+}
+
+/**
+ * @return the size of the frame, 0 for lossless or arithmetic coded jpeg which the decoder can't read
+ */
+func JPEGFrameSize(r io.ReaderAt) (int, int) {
+	list, err := JPEGSegments(r)
+	if nil != err {
+		return 0, 0
+	}
+	var buf [5]byte
+	for _, seg := range list {
+		// baseline, extended and progressive huffman
+		if 0xc0 != seg.Marker && 0xc1 != seg.Marker && 0xc2 != seg.Marker {
+			continue
+		}
+		if seg.Size < 5 {
+			return 0, 0
+		}
+		_, err = r.ReadAt(buf[:], seg.Offset)
+		if nil != err {
+			return 0, 0
+		}
+		return int(binary.BigEndian.Uint16(buf[3:5])), int(binary.BigEndian.Uint16(buf[1:3]))
+	}
+	return 0, 0
+}
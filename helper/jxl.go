@@ -0,0 +1,240 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"gocv.io/x/gocv"
+)
+
+// appended to the name of an original recompressed from jpeg
+const ArchiveExt = ".jxl"
+
+var (
+	jxlContainer = []byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a")
+	// width:height of the codestream size header
+	jxlRatios = [8][2]uint64{{0, 0}, {1, 1}, {12, 10}, {4, 3}, {3, 2}, {16, 9}, {5, 4}, {2, 1}}
+	// directory of cjxl and djxl of libjxl, $PATH when empty
+	jxlTools string
+)
+
+func SetJXLTools(dir string) {
+	jxlTools = dir
+}
+
+func jxlTool(name string) (string, error) {
+	return lookTool(jxlTools, name)
+}
+
+/**
+ * a bare codestream, or one in the ISOBMFF-like container
+ */
+func IsJXL(r io.ReaderAt) bool {
+	var head [12]byte
+	n, _ := r.ReadAt(head[:], 0)
+	return (2 <= n && 0xff == head[0] && 0x0a == head[1]) || (12 == n && bytes.Equal(head[:], jxlContainer))
+}
+
+type bitReader struct {
+	buf  []byte
+	bits uint
+}
+
+// LSB first, 0 past the end
+func (b *bitReader) read(n uint) uint64 {
+	val := uint64(0)
+	for i := uint(0); i < n; i++ {
+		pos := b.bits + i
+		if int(pos/8) < len(b.buf) {
+			val |= uint64(b.buf[pos/8]>>(pos%8)&1) << i
+		}
+	}
+	b.bits += n
+	return val
+}
+
+func (b *bitReader) u32Size() uint64 {
+	return 1 + b.read([4]uint{9, 13, 18, 30}[b.read(2)])
+}
+
+/**
+ * the offset of the codestream, in the jxlc box or the first jxlp one of a container
+ */
+func jxlCodestream(r io.ReaderAt) int64 {
+	var head [16]byte
+	_, err := r.ReadAt(head[:2], 0)
+	if nil == err && 0xff == head[0] && 0x0a == head[1] {
+		return 0
+	}
+	for offset := int64(0); ; {
+		_, err = r.ReadAt(head[:8], offset)
+		if nil != err {
+			return -1
+		}
+		size, hsize := int64(binary.BigEndian.Uint32(head[:4])), int64(8)
+		if 1 == size {
+			_, err = r.ReadAt(head[8:16], offset+8)
+			if nil != err {
+				return -1
+			}
+			size, hsize = int64(binary.BigEndian.Uint64(head[8:16])), 16
+		}
+		switch string(head[4:8]) {
+		case "jxlc":
+			return offset + hsize
+		case "jxlp":
+			// the index of the part
+			return offset + hsize + 4
+		default:
+		}
+		if size < hsize {
+			return -1
+		}
+		offset += size
+	}
+}
+
+/**
+ * the size header of the codestream, before the orientation
+ */
+func jxlSize(r io.ReaderAt) (int, int) {
+	offset := jxlCodestream(r)
+	if offset < 0 {
+		return 0, 0
+	}
+	buf := make([]byte, 16)
+	n, _ := r.ReadAt(buf, offset)
+	if n < 3 || 0xff != buf[0] || 0x0a != buf[1] {
+		return 0, 0
+	}
+	br := &bitReader{buf: buf[2:n]}
+	var width, height uint64
+	if 1 == br.read(1) {
+		height = (1 + br.read(5)) * 8
+		if ratio := br.read(3); 0 != ratio {
+			width = height * jxlRatios[ratio][0] / jxlRatios[ratio][1]
+		} else {
+			width = (1 + br.read(5)) * 8
+		}
+	} else {
+		height = br.u32Size()
+		if ratio := br.read(3); 0 != ratio {
+			width = height * jxlRatios[ratio][0] / jxlRatios[ratio][1]
+		} else {
+			width = br.u32Size()
+		}
+	}
+	return int(width), int(height)
+}
+
+/**
+ * decoded by djxl upright and in sRGB, a recompressed jpeg as well
+ */
+func ReadJXL(absPath string) (*gocv.Mat, error) {
+	bin, err := jxlTool("djxl")
+	if nil != err {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp("", "jxl")
+	if nil != err {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	png := path.Join(tmpDir, "decoded.png")
+	err = runTool(bin, absPath, png, "--bits_per_sample=8", "--color_space=RGB_D65_SRG_Rel_SRG")
+	if nil != err {
+		return nil, err
+	}
+	mat := gocv.IMRead(png, gocv.IMReadColor)
+	if mat.Empty() {
+		mat.Close()
+		return nil, errors.New("load image failed")
+	}
+	return &mat, nil
+}
+
+func writeJXL(mat gocv.Mat, dst string, quality int) error {
+	bin, err := jxlTool("cjxl")
+	if nil != err {
+		return err
+	}
+	png := dst + ".png"
+	if !gocv.IMWrite(png, mat) {
+		return errors.New("save image failed")
+	}
+	defer os.Remove(png)
+	return runTool(bin, png, dst, "-q", strconv.Itoa(quality))
+}
+
+/**
+ * recompress the jpeg src losslessly into dst, kept only when djxl gives back the bytes of the sha-256 hash
+ */
+func ArchiveJPEG(src, dst, hash string) error {
+	cjxl, err := jxlTool("cjxl")
+	if nil != err {
+		return err
+	}
+	djxl, err := jxlTool("djxl")
+	if nil != err {
+		return err
+	}
+	uuid, err := GenUUIDStr()
+	if nil != err {
+		return err
+	}
+	tmp := path.Join(path.Dir(dst), "."+uuid+ArchiveExt)
+	restored := tmp + ".jpg"
+	defer os.Remove(restored)
+	err = runTool(cjxl, src, tmp, "--lossless_jpeg=1")
+	if nil == err {
+		err = runTool(djxl, tmp, restored)
+	}
+	if nil == err {
+		err = sameHash(restored, hash)
+	}
+	if nil != err {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func sameHash(fileName, hash string) error {
+	fp, err := os.Open(fileName)
+	if nil != err {
+		return err
+	}
+	defer fp.Close()
+	digest, err := Sha256ByFile(fp)
+	if nil == err && digest != hash {
+		err = errors.New("not restored bit-exact")
+	}
+	return err
+}
+
+/**
+ * reconstruct the jpeg of an archived original into dst, renamed into place once complete
+ */
+func RestoreJPEG(src, dst string) error {
+	bin, err := jxlTool("djxl")
+	if nil != err {
+		return err
+	}
+	uuid, err := GenUUIDStr()
+	if nil != err {
+		return err
+	}
+	tmp := path.Join(path.Dir(dst), "."+uuid+".jpg")
+	err = runTool(bin, src, tmp)
+	if nil != err {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,84 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// LSB first, as the codestream is read
+type testBitWriter struct {
+	buf  []byte
+	bits uint
+}
+
+func (b *testBitWriter) write(n uint, val uint64) *testBitWriter {
+	for i := uint(0); i < n; i++ {
+		if 0 == b.bits%8 {
+			b.buf = append(b.buf, 0)
+		}
+		b.buf[len(b.buf)-1] |= byte(val>>i&1) << (b.bits % 8)
+		b.bits++
+	}
+	return b
+}
+
+// a size of U32 with the selector of 9, 13, 18 or 30 bits
+func (b *testBitWriter) u32Size(selector uint64, size uint64) *testBitWriter {
+	return b.write(2, selector).write([4]uint{9, 13, 18, 30}[selector], size-1)
+}
+
+func testCodestream(bw *testBitWriter) []byte {
+	return append([]byte{0xff, 0x0a}, bw.buf...)
+}
+
+func testJXLBox(boxType string, payload []byte) []byte {
+	buf := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(8+len(payload)))
+	copy(buf[4:], boxType)
+	return append(buf, payload...)
+}
+
+func TestJXLSize(t *testing.T) {
+	large := testCodestream((&testBitWriter{}).write(1, 0).u32Size(1, 1200).write(3, 5))
+	// a box whose 64-bit size is read from the header after the type
+	free := make([]byte, 16, 20)
+	binary.BigEndian.PutUint32(free, 1)
+	copy(free[4:], "free")
+	binary.BigEndian.PutUint64(free[8:], 20)
+	free = append(free, 0, 0, 0, 0)
+	cases := []struct {
+		name   string
+		file   []byte
+		width  int
+		height int
+	}{
+		{"small by ratio", testCodestream((&testBitWriter{}).write(1, 1).write(5, 7).write(3, 1)), 64, 64},
+		{"small explicit", testCodestream((&testBitWriter{}).write(1, 1).write(5, 7).write(3, 0).write(5, 9)), 80, 64},
+		{"large 16:9", large, 2133, 1200},
+		{"large explicit", testCodestream((&testBitWriter{}).write(1, 0).u32Size(0, 500).write(3, 0).u32Size(3, 100000)), 100000, 500},
+		{"jxlc", bytes.Join([][]byte{jxlContainer, testJXLBox("ftyp", []byte("jxl \x00\x00\x00\x00jxl ")), testJXLBox("jxlc", large)}, nil), 2133, 1200},
+		{"jxlp", bytes.Join([][]byte{jxlContainer, testJXLBox("jxlp", append([]byte{0, 0, 0, 0}, large...))}, nil), 2133, 1200},
+		{"64-bit box", bytes.Join([][]byte{jxlContainer, free, testJXLBox("jxlc", large)}, nil), 2133, 1200},
+		{"truncated", []byte{0xff, 0x0a}, 0, 0},
+		{"no codestream", bytes.Join([][]byte{jxlContainer, testJXLBox("ftyp", nil)}, nil), 0, 0},
+		{"box under its header", append(append([]byte{}, jxlContainer...), 0, 0, 0, 4, 'f', 'r', 'e', 'e'), 0, 0},
+		{"jpeg", []byte{0xff, 0xd8, 0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0}, 0, 0},
+		{"empty", nil, 0, 0},
+	}
+	for _, c := range cases {
+		width, height := jxlSize(bytes.NewReader(c.file))
+		if width != c.width || height != c.height {
+			t.Errorf("%s: got %dx%d", c.name, width, height)
+		}
+	}
+}
+
+func TestIsJXL(t *testing.T) {
+	if !IsJXL(bytes.NewReader([]byte{0xff, 0x0a, 0})) || !IsJXL(bytes.NewReader(jxlContainer)) {
+		t.Error("want a jxl")
+	}
+	if IsJXL(bytes.NewReader([]byte{0xff, 0xd8, 0xff})) || IsJXL(bytes.NewReader(jxlContainer[:8])) {
+		t.Error("want no jxl")
+	}
+}
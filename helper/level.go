@@ -0,0 +1,144 @@
+package helper
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/**
+ * a named rendition profile, e.g. preview, thumb
+ */
+type Level struct {
+	Name     string
+	Resize   Resize
+	Formats  []string // extNames, empty for defaultFormats
+	Animated bool     // an animated webp of an animated original, the other formats take the first frame
+}
+
+var (
+	DefaultLevels = []Level{
+		{Name: "preview", Resize: Resize{Width: 960, Height: 960, Fit: "contain", Quality: 64}, Animated: true},
+		{Name: "thumb", Resize: Resize{Width: 320, Height: 320, Fit: "contain", Quality: 50}},
+	}
+	// the format of the renditions before the levels were configurable
+	defaultFormats = []string{".webp"}
+	levelName      = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+	// names taken by the other levs
+	reservedLevels = map[string]bool{"raw": true, "motion": true, "derived": true}
+)
+
+/**
+ * name WxH [contain|cover|smart] [qN] [animated] [webp,jpg,...], e.g. "tablet 1600x1600 contain q70 webp,jpg"
+ */
+func ParseLevel(line string) (*Level, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("name and size required")
+	}
+	level := &Level{Name: fields[0], Resize: Resize{Fit: "contain", Quality: DefaultQuality}}
+	if !levelName.MatchString(level.Name) || reservedLevels[level.Name] {
+		return nil, errors.New("invalid name " + level.Name)
+	}
+	size := strings.SplitN(fields[1], "x", 2)
+	if 2 != len(size) {
+		return nil, errors.New("invalid size " + fields[1])
+	}
+	var err error
+	level.Resize.Width, err = strconv.Atoi(size[0])
+	if nil == err {
+		level.Resize.Height, err = strconv.Atoi(size[1])
+	}
+	r := &level.Resize
+	if nil != err || r.Width < 0 || r.Height < 0 || 0 == r.Width+r.Height {
+		return nil, errors.New("invalid size " + fields[1])
+	}
+
+	for _, field := range fields[2:] {
+		switch {
+		case "contain" == field || "cover" == field || "smart" == field:
+			r.Fit = field
+		case "animated" == field:
+			level.Animated = true
+		case strings.HasPrefix(field, "q"):
+			r.Quality, err = strconv.Atoi(field[1:])
+			if nil != err || r.Quality < 1 || 100 < r.Quality {
+				return nil, errors.New("invalid quality " + field)
+			}
+		default:
+			for _, name := range strings.Split(field, ",") {
+				ext := "." + strings.TrimPrefix(strings.ToLower(name), ".")
+				if ".jpeg" == ext {
+					ext = ".jpg"
+				}
+				if !isFormat(ext) {
+					return nil, errors.New("unknown format " + name)
+				}
+				level.Formats = append(level.Formats, ext)
+			}
+		}
+	}
+	if 0 == r.Width || 0 == r.Height {
+		r.Fit = "contain"
+	}
+	return level, nil
+}
+
+/**
+ * formats to generate, those without an encoder are left out
+ */
+func (l *Level) Exts() []string {
+	available := RenditionFormats()
+	configured := l.Configured()
+	exts := make([]string, 0, len(configured))
+	for _, ext := range configured {
+		for _, item := range available {
+			if ext == item {
+				exts = append(exts, ext)
+				break
+			}
+		}
+	}
+	return exts
+}
+
+/**
+ * formats set in the config, whether their encoders are found or not, webp when none is set.
+ * Renditions in the others are no longer wanted
+ */
+func (l *Level) Configured() []string {
+	if 0 == len(l.Formats) {
+		return defaultFormats
+	}
+	return l.Formats
+}
+
+/**
+ * signature of the settings, renditions generated by another one are stale
+ */
+func (l *Level) Sig() string {
+	sig := l.Resize.Lev()
+	if 0 < len(l.Formats) {
+		names := make([]string, len(l.Formats))
+		for i, ext := range l.Formats {
+			names[i] = ext[1:]
+		}
+		sig += "-" + strings.Join(names, ",")
+	}
+	if l.Animated {
+		sig += "-animated"
+	}
+	return sig
+}
+
+/**
+ * the directory of a lev under the root, the sizes of ?w=&h= are kept in derived
+ */
+func RenditionDir(lev string) string {
+	if levelName.MatchString(lev) {
+		return lev
+	}
+	return path.Join("derived", lev)
+}
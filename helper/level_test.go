@@ -0,0 +1,69 @@
+package helper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		line string
+		want *Level
+	}{
+		{"tablet 1600x1600", &Level{Name: "tablet", Resize: Resize{Width: 1600, Height: 1600, Fit: "contain", Quality: DefaultQuality}}},
+		{"tablet 1600x1600 cover q70 animated webp,JPEG", &Level{
+			Name:     "tablet",
+			Resize:   Resize{Width: 1600, Height: 1600, Fit: "cover", Quality: 70},
+			Formats:  []string{".webp", ".jpg"},
+			Animated: true,
+		}},
+		{"wide 1200x0 smart", &Level{Name: "wide", Resize: Resize{Width: 1200, Fit: "contain", Quality: DefaultQuality}}},
+		{"x_2 0x200 .avif", &Level{Name: "x_2", Resize: Resize{Height: 200, Fit: "contain", Quality: DefaultQuality}, Formats: []string{".avif"}}},
+		{"tablet", nil},
+		{"", nil},
+		{"Tablet 100x100", nil},
+		{"2x 100x100", nil},
+		{"tab-let 100x100", nil},
+		{"a23456789012345678901234567890123 100x100", nil},
+		{"raw 100x100", nil},
+		{"motion 100x100", nil},
+		{"derived 100x100", nil},
+		{"tablet 0x0", nil},
+		{"tablet 100", nil},
+		{"tablet -1x100", nil},
+		{"tablet axb", nil},
+		{"tablet 100x100 q0", nil},
+		{"tablet 100x100 q101", nil},
+		{"tablet 100x100 q", nil},
+		{"tablet 100x100 gif", nil},
+		{"tablet 100x100 webp,", nil},
+	}
+	for _, c := range cases {
+		got, err := ParseLevel(c.line)
+		if nil == c.want {
+			if nil == err {
+				t.Errorf("%q: want an error, got %v", c.line, got)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("%q: %s", c.line, err.Error())
+			continue
+		}
+		if got.Name != c.want.Name || got.Resize != c.want.Resize || got.Animated != c.want.Animated ||
+			strings.Join(got.Formats, ",") != strings.Join(c.want.Formats, ",") {
+			t.Errorf("%q: got %v", c.line, got)
+		}
+	}
+}
+
+func TestLevelConfigured(t *testing.T) {
+	level := &Level{Name: "thumb"}
+	if got := strings.Join(level.Configured(), ","); ".webp" != got {
+		t.Errorf("default: got %s", got)
+	}
+	level.Formats = []string{".jxl", ".jpg"}
+	if got := strings.Join(level.Configured(), ","); ".jxl,.jpg" != got {
+		t.Errorf("configured: got %s", got)
+	}
+}
@@ -0,0 +1,247 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/**
+ * bounds of decoding an original, 0 for no bound
+ */
+type DecodeLimits struct {
+	MaxPixels int64
+	MaxSide   int
+	MaxMemory int64 // bytes
+	Timeout   time.Duration
+}
+
+const (
+	tagImageWidth  = 0x0100
+	tagImageLength = 0x0101
+	// the decoded 8 bits BGRA and a working copy of it
+	decodeBytesPerPixel = 8
+)
+
+var (
+	// files out of the limits, not to retry
+	ErrUnrenderable = errors.New("unrenderable")
+	// decoding past the timeout, retried since a busy host is as slow
+	ErrTimeout = errors.New("timed out")
+
+	DefaultDecodeLimits = DecodeLimits{
+		MaxPixels: 200000000,
+		MaxSide:   65500,
+		MaxMemory: 2 << 30,
+		Timeout:   2 * time.Minute,
+	}
+	limits = DefaultDecodeLimits
+)
+
+func init() {
+	SetDecodeLimits(DefaultDecodeLimits)
+}
+
+/**
+ * must be called before the first decoding, OpenCV reads its own limits once
+ */
+func SetDecodeLimits(l DecodeLimits) {
+	limits = l
+	if 0 < l.MaxPixels {
+		os.Setenv("OPENCV_IO_MAX_IMAGE_PIXELS", strconv.FormatInt(l.MaxPixels, 10))
+	}
+	if 0 < l.MaxSide {
+		os.Setenv("OPENCV_IO_MAX_IMAGE_WIDTH", strconv.Itoa(l.MaxSide))
+		os.Setenv("OPENCV_IO_MAX_IMAGE_HEIGHT", strconv.Itoa(l.MaxSide))
+	}
+}
+
+func checkSize(width, height int) error {
+	pixels := int64(width) * int64(height)
+	switch {
+	case 0 < limits.MaxSide && (limits.MaxSide < width || limits.MaxSide < height):
+	case 0 < limits.MaxPixels && limits.MaxPixels < pixels:
+	case 0 < limits.MaxMemory && limits.MaxMemory < pixels*decodeBytesPerPixel:
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %dx%d exceeds the decode limits", ErrUnrenderable, width, height)
+}
+
+/**
+ * the largest frame of any jpeg process, unlike JPEGFrameSize
+ */
+func jpegSize(r io.ReaderAt) (int, int) {
+	list, err := JPEGSegments(r)
+	if nil != err {
+		return 0, 0
+	}
+	width, height := 0, 0
+	var buf [5]byte
+	for _, seg := range list {
+		// SOF0-15 but DHT, JPG and DAC
+		if seg.Marker < 0xc0 || 0xcf < seg.Marker || 0xc4 == seg.Marker || 0xc8 == seg.Marker || 0xcc == seg.Marker {
+			continue
+		}
+		if seg.Size < 5 {
+			continue
+		}
+		if _, err = r.ReadAt(buf[:], seg.Offset); nil != err {
+			continue
+		}
+		width = max(width, int(binary.BigEndian.Uint16(buf[3:5])))
+		height = max(height, int(binary.BigEndian.Uint16(buf[1:3])))
+	}
+	return width, height
+}
+
+/**
+ * the largest image of IFD0 and its chain
+ */
+func tiffSize(r io.ReaderAt) (int, int) {
+	tf, offset, err := newTiff(r, 0)
+	width, height := 0, 0
+	for i := 0; nil == err && 0 != offset && i < 64; i++ {
+		var list []tiffEntry
+		list, offset, err = tf.readIFD(offset)
+		if nil != err {
+			break
+		}
+		if entry := findEntry(list, tagImageWidth); nil != entry {
+			width = max(width, int(tf.uint(entry)))
+		}
+		if entry := findEntry(list, tagImageLength); nil != entry {
+			height = max(height, int(tf.uint(entry)))
+		}
+	}
+	return width, height
+}
+
+/**
+ * the largest ispe property, which every coded image of a heif must have
+ */
+func heifSize(r io.ReaderAt) (int, int) {
+	ipco, err := FindBoxPath(r, 0, -1, "meta", "iprp", "ipco")
+	if nil != err {
+		return 0, 0
+	}
+	list, err := ReadBoxes(r, ipco.Offset, ipco.Offset+ipco.Size)
+	if nil != err {
+		return 0, 0
+	}
+	width, height := 0, 0
+	for i := range list {
+		if "ispe" != list[i].Type {
+			continue
+		}
+		buf, err := ReadBox(r, &list[i])
+		if nil == err && 12 <= len(buf) {
+			width = max(width, int(binary.BigEndian.Uint32(buf[4:8])))
+			height = max(height, int(binary.BigEndian.Uint32(buf[8:12])))
+		}
+	}
+	return width, height
+}
+
+/**
+ * dimensions read from the header, 0 for an unknown format, left to the limits of OpenCV
+ */
+func imageSize(r io.ReaderAt) (int, int) {
+	var head [32]byte
+	n, _ := r.ReadAt(head[:], 0)
+	buf := head[:n]
+	switch {
+	case IsJPEG(r):
+		return jpegSize(r)
+	case IsJXL(r):
+		return jxlSize(r)
+	case nil != byteOrder(buf[:min(2, n)]):
+		return tiffSize(r)
+	case 24 <= n && bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")):
+		return int(binary.BigEndian.Uint32(buf[16:20])), int(binary.BigEndian.Uint32(buf[20:24]))
+	case 10 <= n && bytes.HasPrefix(buf, []byte("GIF8")):
+		return int(binary.LittleEndian.Uint16(buf[6:8])), int(binary.LittleEndian.Uint16(buf[8:10]))
+	case 26 <= n && bytes.HasPrefix(buf, []byte("BM")):
+		height := int(int32(binary.LittleEndian.Uint32(buf[22:26])))
+		return int(int32(binary.LittleEndian.Uint32(buf[18:22]))), max(height, -height)
+	case 30 <= n && "RIFF" == string(buf[:4]) && "WEBP" == string(buf[8:12]):
+		switch string(buf[12:16]) {
+		case "VP8 ":
+			return int(binary.LittleEndian.Uint16(buf[26:28]) & 0x3fff), int(binary.LittleEndian.Uint16(buf[28:30]) & 0x3fff)
+		case "VP8L":
+			bits := binary.LittleEndian.Uint32(buf[21:25])
+			return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1
+		case "VP8X":
+			return int(uint32(buf[24])|uint32(buf[25])<<8|uint32(buf[26])<<16) + 1,
+				int(uint32(buf[27])|uint32(buf[28])<<8|uint32(buf[29])<<16) + 1
+		default:
+		}
+	default:
+	}
+	return 0, 0
+}
+
+/**
+ * refuse the original before decoding when its header is out of the limits
+ */
+func checkSource(fp *os.File, brand string, isRaw bool) error {
+	switch {
+	case isRaw:
+		// the previews are checked one by one, the raw data by readSource before it falls back to OpenCV
+		return nil
+	case heifBrands[brand]:
+		return checkSize(heifSize(fp))
+	case "" != brand:
+		info, err := ReadVideoInfo(fp)
+		if nil != err {
+			return nil
+		}
+		return checkSize(info.Width, info.Height)
+	default:
+	}
+	return checkSize(imageSize(fp))
+}
+
+/**
+ * readSource bounded by the timeout. The decoder can't be interrupted, it is left running and its mat released once done,
+ * without the worker process nothing bounds how many are left behind
+ */
+func decodeSource(absPath string, sizes []Resize) (*gocv.Mat, error) {
+	if limits.Timeout <= 0 {
+		return readSource(absPath, sizes)
+	}
+	type result struct {
+		mat *gocv.Mat
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// out of reach of the recover of the caller
+		defer func() {
+			if e := recover(); nil != e {
+				done <- result{err: fmt.Errorf("%v", e)}
+			}
+		}()
+		mat, err := readSource(absPath, sizes)
+		done <- result{mat, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.mat, res.err
+	case <-time.After(limits.Timeout):
+	}
+	go func() {
+		if res := <-done; nil != res.mat {
+			res.mat.Close()
+		}
+	}()
+	return nil, fmt.Errorf("%w: decoding takes longer than %s", ErrTimeout, limits.Timeout)
+}
@@ -0,0 +1,177 @@
+package helper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+const (
+	appleContentIdTag = 0x0011
+	qtContentIdKey    = "com.apple.quicktime.content.identifier"
+)
+
+var (
+	xmpItemReg = regexp.MustCompile(`<Container:Item\b[^>]*>`)
+	xmpAttrReg = regexp.MustCompile(`([\w]+:[\w]+)="([^"]*)"`)
+	microVideo = regexp.MustCompile(`GCamera:MicroVideoOffset="(\d+)"`)
+)
+
+/**
+ * content identifier apple shares between the still and the video of a live photo
+ */
+func ContentIdentifier(fileName string) string {
+	fp, err := os.Open(fileName)
+	if nil != err {
+		return ""
+	}
+	defer fp.Close()
+
+	if "" != FileBrand(fp) && !IsHeif(fp) {
+		return quickTimeContentId(fp)
+	}
+	exif, err := ReadExif(fileName)
+	if nil != err {
+		return ""
+	}
+	list, note := appleMakerNote(exif)
+	entry := findEntry(list, appleContentIdTag)
+	if nil == entry {
+		return ""
+	}
+	return note.str(entry)
+}
+
+/**
+ * the key is listed in moov/meta/keys, and its value stored in moov/meta/ilst by 1-based index
+ */
+func quickTimeContentId(r io.ReaderAt) string {
+	keys, err := FindBoxPath(r, 0, -1, "moov", "meta", "keys")
+	if nil != err {
+		return ""
+	}
+	buf, err := ReadBox(r, keys)
+	if nil != err || len(buf) < 8 {
+		return ""
+	}
+	index := uint32(0)
+	count := binary.BigEndian.Uint32(buf[4:8])
+	buf = buf[8:]
+	for i := uint32(1); i <= count && 8 <= len(buf); i++ {
+		siz := binary.BigEndian.Uint32(buf[:4])
+		if siz < 8 || uint32(len(buf)) < siz {
+			return ""
+		}
+		if qtContentIdKey == string(buf[8:siz]) {
+			index = i
+			break
+		}
+		buf = buf[siz:]
+	}
+	if 0 == index {
+		return ""
+	}
+
+	ilst, err := FindBoxPath(r, 0, -1, "moov", "meta", "ilst")
+	if nil != err {
+		return ""
+	}
+	items, err := ReadBoxes(r, ilst.Offset, ilst.Offset+ilst.Size)
+	if nil != err {
+		return ""
+	}
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], index)
+	item := FindBox(items, string(key[:]))
+	if nil == item {
+		return ""
+	}
+	list, err := ReadBoxes(r, item.Offset, item.Offset+item.Size)
+	if nil != err {
+		return ""
+	}
+	data, err := ReadBox(r, FindBox(list, "data"))
+	// type indicator and locale
+	if nil != err || len(data) < 8 {
+		return ""
+	}
+	return string(data[8:])
+}
+
+/**
+ * find the video a motion photo appended after its jpeg
+ * @return offset and length of the video
+ */
+func MotionPhoto(fp *os.File) (int64, int64, error) {
+	stat, err := fp.Stat()
+	if nil != err {
+		return 0, 0, err
+	}
+	xmp, err := JPEGApp(fp, 0xe1, xmpHeader)
+	if nil != err {
+		return 0, 0, err
+	}
+
+	length := int64(0)
+	found := false
+	for _, item := range xmpItemReg.FindAll(xmp, -1) {
+		attrs := make(map[string]string)
+		for _, kv := range xmpAttrReg.FindAllSubmatch(item, -1) {
+			attrs[string(kv[1])] = string(kv[2])
+		}
+		if "MotionPhoto" == attrs["Item:Semantic"] {
+			found = true
+		}
+		// the video and everything behind it
+		if found {
+			siz, _ := strconv.ParseInt(attrs["Item:Length"], 10, 64)
+			length += siz
+		}
+	}
+	if 0 == length {
+		match := microVideo.FindSubmatch(xmp)
+		if nil != match {
+			length, _ = strconv.ParseInt(string(match[1]), 10, 64)
+		}
+	}
+	if length < 8 || stat.Size() <= length {
+		return 0, 0, errors.New("motion photo not found")
+	}
+
+	offset := stat.Size() - length
+	if "" == FileBrand(io.NewSectionReader(fp, offset, length)) {
+		return 0, 0, errors.New("broken motion photo")
+	}
+	return offset, length, nil
+}
+
+/**
+ * copy the embedded video of a motion photo out as a companion file
+ * @return baseName, digest and size of the companion
+ */
+func ExtractMotionPhoto(src, dir string) (string, string, int64, error) {
+	fp, err := os.Open(src)
+	if nil != err {
+		return "", "", 0, err
+	}
+	defer fp.Close()
+
+	offset, length, err := MotionPhoto(fp)
+	if nil != err {
+		return "", "", 0, err
+	}
+	section := io.NewSectionReader(fp, offset, length)
+	digest, err := Sha256ByReader(section)
+	if nil != err {
+		return "", "", 0, err
+	}
+	_, err = section.Seek(0, io.SeekStart)
+	if nil != err {
+		return "", "", 0, err
+	}
+	baseName, siz, _, err := CreateNewFile(dir, ".mp4", digest, section)
+	return baseName, digest, siz, err
+}
@@ -0,0 +1,126 @@
+package helper
+
+import (
+	"bytes"
+	"io"
+
+	"gocv.io/x/gocv"
+)
+
+const tagOrientation = 0x0112
+
+// uuid box of cr3 which holds the CMT boxes, CMT1 is IFD0
+var cr3MetaUUID = []byte{0x85, 0xc0, 0xb6, 0x87, 0x82, 0x0f, 0x11, 0xe0, 0x81, 0x11, 0xf4, 0xce, 0x46, 0x2b, 0x6a, 0x48}
+
+/**
+ * @return Orientation of IFD0 in a tiff structured block, 1 when absent
+ */
+func tiffOrientation(r io.ReaderAt, base int64) int {
+	tf, ifd0, err := newTiff(r, base)
+	if nil != err {
+		return 1
+	}
+	list, _, err := tf.readIFD(ifd0)
+	if nil != err {
+		return 1
+	}
+	entry := findEntry(list, tagOrientation)
+	if nil == entry {
+		return 1
+	}
+	orientation := int(tf.uint(entry))
+	if orientation < 1 || 8 < orientation {
+		return 1
+	}
+	return orientation
+}
+
+func exifOrientation(exif []byte) int {
+	return tiffOrientation(bytes.NewReader(exif), 0)
+}
+
+func cr3Orientation(r io.ReaderAt) int {
+	moov, err := FindBoxPath(r, 0, -1, "moov")
+	if nil != err {
+		return 1
+	}
+	list, err := ReadBoxes(r, moov.Offset, moov.Offset+moov.Size)
+	if nil != err {
+		return 1
+	}
+	uuid := make([]byte, len(cr3MetaUUID))
+	for _, box := range list {
+		if "uuid" != box.Type || box.Size < 16 {
+			continue
+		}
+		_, err = r.ReadAt(uuid, box.Offset)
+		if nil != err || !bytes.Equal(cr3MetaUUID, uuid) {
+			continue
+		}
+		cmt, err := FindBoxPath(r, box.Offset+16, box.Offset+box.Size, "CMT1")
+		if nil == err {
+			return tiffOrientation(io.NewSectionReader(r, cmt.Offset, cmt.Size), 0)
+		}
+	}
+	return 1
+}
+
+/**
+ * orientation of a raw, the container has the say, else the embedded jpeg
+ */
+func rawOrientation(r io.ReaderAt, preview *rawPreview) int {
+	switch {
+	case isRAF(r):
+		exif, err := JPEGApp(io.NewSectionReader(r, preview.offset, preview.size), 0xe1, exifHeader)
+		if nil != err {
+			return 1
+		}
+		return exifOrientation(exif)
+	case rawBrands[FileBrand(r)]:
+		return cr3Orientation(r)
+	default:
+	}
+	return tiffOrientation(r, 0)
+}
+
+func rotateMat(mat *gocv.Mat, flag gocv.RotateFlag) {
+	dst := gocv.NewMat()
+	gocv.Rotate(*mat, &dst, flag)
+	mat.Close()
+	*mat = dst
+}
+
+func flipMat(mat *gocv.Mat, flipCode int) {
+	dst := gocv.NewMat()
+	gocv.Flip(*mat, &dst, flipCode)
+	mat.Close()
+	*mat = dst
+}
+
+/**
+ * turn upright by EXIF Orientation 1 to 8.
+ * renditions are encoded from the pixels only, so they carry no orientation to apply twice
+ */
+func orient(mat *gocv.Mat, orientation int) {
+	switch orientation {
+	case 2:
+		flipMat(mat, 1)
+	case 3:
+		rotateMat(mat, gocv.Rotate180Clockwise)
+	case 4:
+		flipMat(mat, 0)
+	case 5:
+		// transpose
+		rotateMat(mat, gocv.Rotate90Clockwise)
+		flipMat(mat, 1)
+	case 6:
+		rotateMat(mat, gocv.Rotate90Clockwise)
+	case 7:
+		// transverse
+		rotateMat(mat, gocv.Rotate90Clockwise)
+		flipMat(mat, 0)
+	case 8:
+		rotateMat(mat, gocv.Rotate90CounterClockwise)
+	default:
+	}
+}
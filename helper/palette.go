@@ -0,0 +1,200 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// long side the colours are clustered at
+	paletteSide   = 64
+	paletteSize   = 5
+	paletteRounds = 10
+	// clusters of fewer pixels are left out
+	paletteMinWeight = 0.05
+)
+
+/**
+ * a dominant colour, with its CIELAB coordinates for the distance
+ */
+type Swatch struct {
+	Color  string // #rrggbb
+	L      float64
+	A      float64
+	B      float64
+	Weight float64 // share of the pixels
+}
+
+// D65 white of sRGB
+var labWhite = [3]float64{0.95047, 1, 1.08883}
+
+func labF(t float64) float64 {
+	if 216.0/24389 < t {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27*t + 16) / 116
+}
+
+func linearToLab(r, g, b float64) [3]float64 {
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / labWhite[0]
+	y := (0.2126729*r + 0.7151522*g + 0.0721750*b) / labWhite[1]
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / labWhite[2]
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+func labFInv(t float64) float64 {
+	if 6.0/29 < t {
+		return t * t * t
+	}
+	return (116*t - 16) * 27 / 24389
+}
+
+func labToHex(lab [3]float64) string {
+	fy := (lab[0] + 16) / 116
+	x := labFInv(fy+lab[1]/500) * labWhite[0]
+	y := labFInv(fy) * labWhite[1]
+	z := labFInv(fy-lab[2]/200) * labWhite[2]
+	r := 3.2404542*x - 1.5371385*y - 0.4985314*z
+	g := -0.9692660*x + 1.8760108*y + 0.0415560*z
+	b := 0.0556434*x - 0.2040259*y + 1.0572252*z
+	return fmt.Sprintf("#%02x%02x%02x", linearToSRGB(r), linearToSRGB(g), linearToSRGB(b))
+}
+
+/**
+ * #rrggbb or rrggbb
+ */
+func ParseColor(hex string) (*Swatch, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	val, err := strconv.ParseUint(hex, 16, 32)
+	if nil != err || 6 != len(hex) {
+		return nil, errors.New("invalid color " + hex)
+	}
+	lab := linearToLab(srgbToLinear(uint8(val>>16)), srgbToLinear(uint8(val>>8)), srgbToLinear(uint8(val)))
+	return &Swatch{Color: "#" + strings.ToLower(hex), L: lab[0], A: lab[1], B: lab[2], Weight: 1}, nil
+}
+
+func labDist2(p, q *[3]float64) float64 {
+	dl, da, db := p[0]-q[0], p[1]-q[1], p[2]-q[2]
+	return dl*dl + da*da + db*db
+}
+
+/**
+ * small sRGB copy of the picture the placeholders are computed from
+ */
+func sampleOf(mat *gocv.Mat, profile *colorProfile) gocv.Mat {
+	sample, _ := resizeMat(mat, &Resize{Width: paletteSide, Height: paletteSide, Fit: "contain"})
+	if nil != profile {
+		profile.apply(&sample)
+	}
+	return sample
+}
+
+/**
+ * k-means in CIELAB of a BGR, BGRA or gray mat of 8 bits, the heaviest first.
+ * Seeded by the farthest points from the mean so the result is stable; transparent pixels are left out
+ */
+func palette(sample *gocv.Mat) []Swatch {
+	channels := sample.Channels()
+	switch sample.Type() {
+	case gocv.MatTypeCV8U:
+	case gocv.MatTypeCV8UC3:
+	case gocv.MatTypeCV8UC4:
+	default:
+		return nil
+	}
+	data, err := sample.DataPtrUint8()
+	count := sample.Cols() * sample.Rows()
+	if nil != err || len(data) < count*channels {
+		return nil
+	}
+	points := make([][3]float64, 0, count)
+	for i := 0; i < count; i++ {
+		p := data[i*channels:]
+		switch channels {
+		case 1:
+			v := srgbToLinear(p[0])
+			points = append(points, linearToLab(v, v, v))
+			continue
+		case 4:
+			if p[3] < 128 {
+				continue
+			}
+		default:
+		}
+		points = append(points, linearToLab(srgbToLinear(p[2]), srgbToLinear(p[1]), srgbToLinear(p[0])))
+	}
+	if 0 == len(points) {
+		return nil
+	}
+
+	var mean [3]float64
+	for i := range points {
+		for c := 0; c < 3; c++ {
+			mean[c] += points[i][c] / float64(len(points))
+		}
+	}
+	centers := [][3]float64{mean}
+	for len(centers) < paletteSize && len(centers) < len(points) {
+		best, bestDist := 0, -1.0
+		for i := range points {
+			dist := math.Inf(1)
+			for j := range centers {
+				dist = math.Min(dist, labDist2(&points[i], &centers[j]))
+			}
+			if bestDist < dist {
+				best, bestDist = i, dist
+			}
+		}
+		if 0 == bestDist {
+			break
+		}
+		centers = append(centers, points[best])
+	}
+
+	weights := make([]int, len(centers))
+	for round := 0; round < paletteRounds; round++ {
+		sums := make([][3]float64, len(centers))
+		for i := range weights {
+			weights[i] = 0
+		}
+		for i := range points {
+			best, bestDist := 0, math.Inf(1)
+			for j := range centers {
+				if dist := labDist2(&points[i], &centers[j]); dist < bestDist {
+					best, bestDist = j, dist
+				}
+			}
+			weights[best]++
+			for c := 0; c < 3; c++ {
+				sums[best][c] += points[i][c]
+			}
+		}
+		for j := range centers {
+			if 0 < weights[j] {
+				for c := 0; c < 3; c++ {
+					centers[j][c] = sums[j][c] / float64(weights[j])
+				}
+			}
+		}
+	}
+
+	list := make([]Swatch, 0, len(centers))
+	for j, center := range centers {
+		weight := float64(weights[j]) / float64(len(points))
+		if weight < paletteMinWeight {
+			continue
+		}
+		list = append(list, Swatch{Color: labToHex(center), L: center[0], A: center[1], B: center[2], Weight: weight})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[j].Weight < list[i].Weight
+	})
+	return list
+}
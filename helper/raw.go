@@ -0,0 +1,246 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"gocv.io/x/gocv"
+)
+
+// a jpeg embedded in a raw
+type rawPreview struct {
+	offset int64
+	size   int64
+	pixels int
+}
+
+const (
+	tagCompression     = 0x0103
+	tagMake            = 0x010f
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagSubIFDs         = 0x014a
+	tagJPEGOffset      = 0x0201
+	tagJPEGLength      = 0x0202
+	tagDNGVersion      = 0xc612
+)
+
+var (
+	rawBrands = map[string]bool{"crx ": true}
+	rafMagic  = []byte("FUJIFILMCCD-RAW ")
+	// uuid box of cr3 which holds the PRVW box
+	cr3PreviewUUID = []byte{0xea, 0xf4, 0x2b, 0x5e, 0x1c, 0x98, 0x4b, 0x88, 0xb9, 0xfb, 0xb7, 0xdc, 0x40, 0x6e, 0x4d, 0x16}
+)
+
+func isRAF(r io.ReaderAt) bool {
+	buf := make([]byte, len(rafMagic))
+	_, err := r.ReadAt(buf, 0)
+	return nil == err && bytes.Equal(rafMagic, buf)
+}
+
+/**
+ * tiff based raws: CR2, NEF, ARW, DNG and the like, told from plain tiff by the camera tags
+ */
+func isTiffRaw(r io.ReaderAt) bool {
+	tf, ifd0, err := newTiff(r, 0)
+	if nil != err {
+		return false
+	}
+	var cr [2]byte
+	_, err = r.ReadAt(cr[:], 8)
+	if nil == err && "CR" == string(cr[:]) {
+		return true
+	}
+	list, _, err := tf.readIFD(ifd0)
+	if nil != err {
+		return false
+	}
+	return nil != findEntry(list, tagDNGVersion) || nil != findEntry(list, tagMake)
+}
+
+func IsRaw(r io.ReaderAt) bool {
+	return isRAF(r) || rawBrands[FileBrand(r)] || isTiffRaw(r)
+}
+
+func ifdPreviews(tf *tiffFile, list []tiffEntry) []rawPreview {
+	previews := make([]rawPreview, 0, 2)
+	offset, length := findEntry(list, tagJPEGOffset), findEntry(list, tagJPEGLength)
+	if nil != offset && nil != length {
+		previews = append(previews, rawPreview{offset: int64(tf.uint(offset)), size: int64(tf.uint(length))})
+	}
+	// a jpeg compressed image in a single strip, which may also be the lossless raw data itself
+	offset, length = findEntry(list, tagStripOffsets), findEntry(list, tagStripByteCounts)
+	compression := findEntry(list, tagCompression)
+	if nil != offset && nil != length && nil != compression && 1 == offset.Count && 1 == length.Count {
+		if c := tf.uint(compression); 6 == c || 7 == c {
+			previews = append(previews, rawPreview{offset: int64(tf.uint(offset)), size: int64(tf.uint(length))})
+		}
+	}
+	return previews
+}
+
+/**
+ * walk the IFD chain and the SubIFDs
+ */
+func tiffPreviews(r io.ReaderAt) []rawPreview {
+	tf, ifd0, err := newTiff(r, 0)
+	if nil != err {
+		return nil
+	}
+	previews := make([]rawPreview, 0)
+	queue := []uint32{ifd0}
+	seen := make(map[uint32]bool)
+	for 0 < len(queue) && len(seen) < 32 {
+		offset := queue[0]
+		queue = queue[1:]
+		if 0 == offset || seen[offset] {
+			continue
+		}
+		seen[offset] = true
+		list, next, err := tf.readIFD(offset)
+		if nil != err {
+			continue
+		}
+		queue = append(queue, next)
+		if entry := findEntry(list, tagSubIFDs); nil != entry {
+			queue = append(queue, tf.uints(entry)...)
+		}
+		previews = append(previews, ifdPreviews(tf, list)...)
+	}
+	return previews
+}
+
+/**
+ * the full size jpeg in the first track, and the PRVW in the preview uuid box
+ */
+func cr3Previews(r io.ReaderAt) []rawPreview {
+	previews := make([]rawPreview, 0, 2)
+	list, err := ReadBoxes(r, 0, -1)
+	if nil != err {
+		return nil
+	}
+	uuid := make([]byte, len(cr3PreviewUUID))
+	for _, box := range list {
+		if "uuid" != box.Type || box.Size < 24 {
+			continue
+		}
+		_, err = r.ReadAt(uuid, box.Offset)
+		if nil != err || !bytes.Equal(cr3PreviewUUID, uuid) {
+			continue
+		}
+		// uuid and 8 unknown bytes
+		prvw, err := FindBoxPath(r, box.Offset+24, box.Offset+box.Size, "PRVW")
+		if nil != err || prvw.Size < 16 {
+			continue
+		}
+		var siz [4]byte
+		_, err = r.ReadAt(siz[:], prvw.Offset+12)
+		if nil == err {
+			previews = append(previews, rawPreview{offset: prvw.Offset + 16, size: int64(binary.BigEndian.Uint32(siz[:]))})
+		}
+	}
+
+	moov := FindBox(list, "moov")
+	if nil == moov {
+		return previews
+	}
+	stbl, err := FindBoxPath(r, moov.Offset, moov.Offset+moov.Size, "trak", "mdia", "minf", "stbl")
+	if nil != err {
+		return previews
+	}
+	list, err = ReadBoxes(r, stbl.Offset, stbl.Offset+stbl.Size)
+	if nil != err {
+		return previews
+	}
+	stsz, err := ReadBox(r, FindBox(list, "stsz"))
+	if nil != err || len(stsz) < 16 {
+		return previews
+	}
+	siz := binary.BigEndian.Uint32(stsz[4:8])
+	if 0 == siz {
+		siz = binary.BigEndian.Uint32(stsz[12:16])
+	}
+	if co64, err := ReadBox(r, FindBox(list, "co64")); nil == err && 16 <= len(co64) {
+		previews = append(previews, rawPreview{offset: int64(binary.BigEndian.Uint64(co64[8:16])), size: int64(siz)})
+	} else if stco, err := ReadBox(r, FindBox(list, "stco")); nil == err && 12 <= len(stco) {
+		previews = append(previews, rawPreview{offset: int64(binary.BigEndian.Uint32(stco[8:12])), size: int64(siz)})
+	}
+	return previews
+}
+
+func rafPreviews(r io.ReaderAt) []rawPreview {
+	var buf [8]byte
+	_, err := r.ReadAt(buf[:], 84)
+	if nil != err {
+		return nil
+	}
+	return []rawPreview{{offset: int64(binary.BigEndian.Uint32(buf[0:4])), size: int64(binary.BigEndian.Uint32(buf[4:8]))}}
+}
+
+/**
+ * @return decodable previews, the largest first
+ */
+func rawPreviews(r io.ReaderAt) []rawPreview {
+	var list []rawPreview
+	switch {
+	case isRAF(r):
+		list = rafPreviews(r)
+	case rawBrands[FileBrand(r)]:
+		list = cr3Previews(r)
+	default:
+		list = tiffPreviews(r)
+	}
+
+	previews := make([]rawPreview, 0, len(list))
+	for _, item := range list {
+		if item.offset <= 0 || item.size <= 0 || 1<<26 < item.size {
+			continue
+		}
+		width, height := JPEGFrameSize(io.NewSectionReader(r, item.offset, item.size))
+		if 0 < width && 0 < height {
+			item.pixels = width * height
+			previews = append(previews, item)
+		}
+	}
+	sort.SliceStable(previews, func(i, j int) bool {
+		return previews[j].pixels < previews[i].pixels
+	})
+	return previews
+}
+
+/**
+ * decode the largest embedded jpeg preview of a camera raw, turned upright, shrunk on load to what sizes need
+ */
+func ReadRawPreview(fileName string, sizes []Resize) (*gocv.Mat, error) {
+	fp, err := os.Open(fileName)
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+
+	for _, item := range rawPreviews(fp) {
+		width, height := JPEGFrameSize(io.NewSectionReader(fp, item.offset, item.size))
+		if nil != checkSize(width, height) {
+			continue
+		}
+		buf := make([]byte, item.size)
+		_, err = fp.ReadAt(buf, item.offset)
+		if nil != err {
+			continue
+		}
+		mat, err := gocv.IMDecode(buf, reduceFlag(width, height, sizes)|gocv.IMReadIgnoreOrientation)
+		if nil != err {
+			continue
+		}
+		if !mat.Empty() {
+			orient(&mat, rawOrientation(fp, &item))
+			return &mat, nil
+		}
+		mat.Close()
+	}
+	return nil, errors.New("embedded preview not found")
+}
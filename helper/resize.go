@@ -0,0 +1,257 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+
+	"gocv.io/x/gocv"
+)
+
+type Resize struct {
+	Width   int // 0 for free
+	Height  int // 0 for free
+	Fit     string
+	Quality int
+}
+
+const DefaultQuality = 64
+
+func queryInt(query url.Values, key string, def int) (int, error) {
+	val := query.Get(key)
+	if "" == val {
+		return def, nil
+	}
+	num, err := strconv.Atoi(val)
+	if nil != err || num < 0 {
+		return 0, errors.New("invalid " + key)
+	}
+	return num, nil
+}
+
+/**
+ * ?w=&h=&fit=contain|cover|smart&q=
+ */
+func ParseResize(query url.Values) (*Resize, error) {
+	var err error
+	r := &Resize{Fit: query.Get("fit")}
+	if "" == r.Fit {
+		r.Fit = "contain"
+	}
+	if "contain" != r.Fit && "cover" != r.Fit && "smart" != r.Fit {
+		return nil, errors.New("invalid fit")
+	}
+	r.Width, err = queryInt(query, "w", 0)
+	if nil == err {
+		r.Height, err = queryInt(query, "h", 0)
+	}
+	if nil == err {
+		r.Quality, err = queryInt(query, "q", DefaultQuality)
+	}
+	if nil != err {
+		return nil, err
+	}
+	if r.Quality < 1 || 100 < r.Quality {
+		return nil, errors.New("invalid q")
+	}
+	if 0 == r.Width && 0 == r.Height {
+		return nil, errors.New("w or h required")
+	}
+	// nothing to crop when one side is free
+	if 0 == r.Width || 0 == r.Height {
+		r.Fit = "contain"
+	}
+	return r, nil
+}
+
+func (r *Resize) Size() string {
+	return fmt.Sprintf("%dx%d", r.Width, r.Height)
+}
+
+func (r *Resize) Lev() string {
+	return fmt.Sprintf("%dx%d-%s-q%d", r.Width, r.Height, r.Fit, r.Quality)
+}
+
+/**
+ * the part of a width x height image kept, cover and smart crop to the aspect ratio of the box
+ */
+func (r *Resize) cropSize(width, height int) (int, int) {
+	if "cover" != r.Fit && "smart" != r.Fit {
+		return width, height
+	}
+	cw, ch := width, width*r.Height/r.Width
+	if height < ch {
+		cw, ch = height*r.Width/r.Height, height
+	}
+	return cw, ch
+}
+
+/**
+ * the scale to a width x height image, over 1 when it is smaller than the box
+ */
+func (r *Resize) scaleOf(width, height int) float64 {
+	width, height = r.cropSize(width, height)
+	scale := math.Inf(1)
+	if 0 < r.Width {
+		scale = math.Min(scale, float64(r.Width)/float64(width))
+	}
+	if 0 < r.Height {
+		scale = math.Min(scale, float64(r.Height)/float64(height))
+	}
+	return scale
+}
+
+/**
+ * scale into the box without upscaling, cover crops the center to the aspect ratio of the box,
+ * smart crops the part with the faces or the most details
+ * @return the resized and the crop box
+ */
+func resizeMat(mat *gocv.Mat, r *Resize) (gocv.Mat, image.Rectangle) {
+	width, height := mat.Cols(), mat.Rows()
+	src := *mat
+	box := image.Rect(0, 0, width, height)
+	scale := math.Min(1, r.scaleOf(width, height))
+
+	if cw, ch := r.cropSize(width, height); cw != width || ch != height {
+		if "smart" == r.Fit {
+			box = smartCrop(mat, cw, ch)
+		} else {
+			x, y := (width-cw)/2, (height-ch)/2
+			box = image.Rect(x, y, x+cw, y+ch)
+		}
+		src = mat.Region(box)
+		defer src.Close()
+		width, height = cw, ch
+	}
+
+	dst := gocv.NewMat()
+	sz := image.Pt(int(math.Round(float64(width)*scale)), int(math.Round(float64(height)*scale)))
+	if sz.X < 1 {
+		sz.X = 1
+	}
+	if sz.Y < 1 {
+		sz.Y = 1
+	}
+	gocv.Resize(src, &dst, sz, 0, 0, gocv.InterpolationArea)
+	return dst, box
+}
+
+/**
+ * the DCT scaling of libjpeg, down to 1/8, keeping enough pixels for each of the sizes
+ */
+func reduceFlag(width, height int, sizes []Resize) gocv.IMReadFlag {
+	if width < 1 || height < 1 || 0 == len(sizes) {
+		return gocv.IMReadColor
+	}
+	// the orientation is applied after decoding, either way round will do
+	scale := 0.0
+	for i := range sizes {
+		scale = math.Max(scale, math.Max(sizes[i].scaleOf(width, height), sizes[i].scaleOf(height, width)))
+	}
+	switch {
+	case scale*8 <= 1:
+		return gocv.IMReadReducedColor8
+	case scale*4 <= 1:
+		return gocv.IMReadReducedColor4
+	case scale*2 <= 1:
+		return gocv.IMReadReducedColor2
+	default:
+	}
+	return gocv.IMReadColor
+}
+
+func fileMetaOf(absPath string) (*Meta, error) {
+	fp, err := os.Open(absPath)
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+	return GetMeta(fp)
+}
+
+/**
+ * write to a temporary file first, concurrent requests may generate the same rendition
+ */
+func writeRendition(mat gocv.Mat, dst string, quality int) error {
+	uuid, err := GenUUIDStr()
+	if nil != err {
+		return err
+	}
+	extName := path.Ext(dst)
+	tmp := path.Join(path.Dir(dst), "."+uuid+extName)
+	err = encodeFile(mat, tmp, extName, quality)
+	if nil != err {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+/**
+ * resize the source, convert it to sRGB, and write it in each of the formats
+ * @return the resized as well, for the smaller levels, closed by the caller
+ */
+func genLevel(mat *gocv.Mat, profile *colorProfile, dir, baseName, lev string, r *Resize, exts []string) (gocv.Mat, []Rendition, error) {
+	dst, box := resizeMat(mat, r)
+	crop := cropBox(box, mat.Cols(), mat.Rows())
+	if nil != profile {
+		profile.apply(&dst)
+	}
+
+	err := os.MkdirAll(dir, 0770)
+	if nil != err {
+		return dst, nil, err
+	}
+	list := make([]Rendition, 0, len(exts))
+	for _, extName := range exts {
+		genFile := path.Join(dir, baseName+extName)
+		err = writeRendition(dst, genFile, r.Quality)
+		if nil != err {
+			return dst, nil, err
+		}
+		meta, err := fileMetaOf(genFile)
+		if nil != err {
+			return dst, nil, err
+		}
+		list = append(list, Rendition{Lev: lev, Ext: extName, Crop: crop, Meta: *meta})
+	}
+	return dst, list, nil
+}
+
+/**
+ * generate the rendition of the original src into dir, named baseName+extName
+ */
+func GenResized(src, dir, baseName, extName string, r *Resize) (*Rendition, error) {
+	if 0 == len(workerCmd) {
+		return genResized(src, dir, baseName, extName, r)
+	}
+	res, err := callWorker(&workerRequest{Src: src, Dir: dir, BaseName: baseName, Ext: extName, Resize: r})
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(res.List) {
+		return nil, errors.New("nothing rendered by the worker")
+	}
+	return &res.List[0], nil
+}
+
+func genResized(src, dir, baseName, extName string, r *Resize) (*Rendition, error) {
+	mat, err := decodeSource(src, []Resize{*r})
+	if nil != err {
+		return nil, err
+	}
+	defer mat.Close()
+
+	dst, list, err := genLevel(mat, sourceProfile(src), dir, baseName, r.Lev(), r, []string{extName})
+	dst.Close()
+	if nil != err {
+		return nil, err
+	}
+	list[0].Sig = r.Lev()
+	return &list[0], nil
+}
@@ -0,0 +1,52 @@
+package helper
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseResize(t *testing.T) {
+	cases := []struct {
+		query string
+		want  *Resize
+	}{
+		{"w=320&h=240", &Resize{Width: 320, Height: 240, Fit: "contain", Quality: DefaultQuality}},
+		{"w=320&h=240&fit=cover&q=80", &Resize{Width: 320, Height: 240, Fit: "cover", Quality: 80}},
+		{"w=320&fit=smart", &Resize{Width: 320, Fit: "contain", Quality: DefaultQuality}},
+		{"h=240&q=100", &Resize{Height: 240, Fit: "contain", Quality: 100}},
+		{"q=1&w=1&h=1&fit=smart", &Resize{Width: 1, Height: 1, Fit: "smart", Quality: 1}},
+		{"", nil},
+		{"w=0&h=0", nil},
+		{"w=-1&h=100", nil},
+		{"w=abc", nil},
+		{"w=100&fit=fill", nil},
+		{"w=100&q=0", nil},
+		{"w=100&q=101", nil},
+		{"w=100&q=-5", nil},
+		{"w=100&q=high", nil},
+	}
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		got, err := ParseResize(query)
+		if nil == c.want {
+			if nil == err {
+				t.Errorf("%q: want an error, got %v", c.query, got)
+			}
+			continue
+		}
+		if nil != err || *got != *c.want {
+			t.Errorf("%q: got %v %v", c.query, got, err)
+		}
+	}
+}
+
+func TestResizeLev(t *testing.T) {
+	r := &Resize{Width: 320, Height: 0, Fit: "contain", Quality: 50}
+	if "320x0" != r.Size() || "320x0-contain-q50" != r.Lev() {
+		t.Errorf("got %s %s", r.Size(), r.Lev())
+	}
+	// not a level name, kept under derived
+	if "derived/320x0-contain-q50" != RenditionDir(r.Lev()) || "thumb" != RenditionDir("thumb") {
+		t.Errorf("got %s", RenditionDir(r.Lev()))
+	}
+}
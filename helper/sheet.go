@@ -0,0 +1,176 @@
+package helper
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"path"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// strip under each cell of a contact sheet for the filename
+	sheetLabelHeight = 20
+	sheetGap         = 4
+)
+
+/**
+ * where an asset is drawn on a sheet, in pixels
+ */
+type SheetCell struct {
+	Filename string
+	ETag     string
+	X        int
+	Y        int
+	Width    int
+	Height   int
+}
+
+/**
+ * cells of cell x cell in rows of cols, labelled ones are spaced by a gap and a label strip
+ */
+type SheetLayout struct {
+	Width    int
+	Height   int
+	Cols     int
+	Cell     int
+	Labelled bool
+	Cells    []SheetCell
+}
+
+/**
+ * the gap and the steps between the cells
+ */
+func sheetSteps(cell int, labelled bool) (int, int, int) {
+	if labelled {
+		return sheetGap, cell + sheetGap, cell + sheetGap + sheetLabelHeight
+	}
+	return 0, cell, cell
+}
+
+/**
+ * the most cells of rows of cols fitting in maxSide
+ */
+func SheetCapacity(cols, cell int, labelled bool, maxSide int) int {
+	gap, stepX, stepY := sheetSteps(cell, labelled)
+	if maxSide < gap+cols*stepX {
+		return 0
+	}
+	return (maxSide - gap) / stepY * cols
+}
+
+func NewSheetLayout(cols, cell int, labelled bool, names, eTags []string) *SheetLayout {
+	layout := &SheetLayout{Cols: cols, Cell: cell, Labelled: labelled, Cells: make([]SheetCell, len(names))}
+	gap, stepX, stepY := sheetSteps(cell, labelled)
+	for i := range names {
+		layout.Cells[i] = SheetCell{
+			Filename: names[i],
+			ETag:     eTags[i],
+			X:        gap + i%cols*stepX,
+			Y:        gap + i/cols*stepY,
+			Width:    cell,
+			Height:   cell,
+		}
+	}
+	rows := (len(names) + cols - 1) / cols
+	if rows < 1 {
+		rows = 1
+	}
+	if len(names) < cols {
+		cols = len(names)
+	}
+	if cols < 1 {
+		cols = 1
+	}
+	layout.Width, layout.Height = gap+cols*stepX, gap+rows*stepY
+	return layout
+}
+
+/**
+ * a rendition of ours, upright and in sRGB already
+ */
+func readRendition(absPath string) (*gocv.Mat, error) {
+	if ".avif" == path.Ext(absPath) {
+		return ReadHeif(absPath)
+	}
+	mat := gocv.IMRead(absPath, gocv.IMReadColor)
+	if mat.Empty() {
+		mat.Close()
+		return nil, errors.New("load image failed")
+	}
+	return &mat, nil
+}
+
+/**
+ * the label cut to the width of the cell
+ */
+func fitLabel(label string, width int) string {
+	runes := []rune(label)
+	for 0 < len(runes) {
+		text := string(runes)
+		if len(runes) < len([]rune(label)) {
+			text += "..."
+		}
+		if gocv.GetTextSize(text, gocv.FontHersheySimplex, 0.4, 1).X <= width {
+			return text
+		}
+		runes = runes[:len(runes)-1]
+	}
+	return ""
+}
+
+/**
+ * draw the renditions of files, one for each cell, into the cells of the layout, fit by contain or cover.
+ * An empty file or one failing to decode leaves its cell blank
+ * @return the sheet encoded in ext
+ */
+func RenderSheet(layout *SheetLayout, files []string, fit, ext string, quality int) ([]byte, error) {
+	bg := gocv.NewScalar(0, 0, 0, 0)
+	if layout.Labelled {
+		bg = gocv.NewScalar(255, 255, 255, 0)
+	}
+	sheet := gocv.NewMatWithSizeFromScalar(bg, layout.Height, layout.Width, gocv.MatTypeCV8UC3)
+	defer sheet.Close()
+
+	r := &Resize{Width: layout.Cell, Height: layout.Cell, Fit: fit}
+	for i, cell := range layout.Cells {
+		if layout.Labelled {
+			gocv.PutText(&sheet, fitLabel(cell.Filename, cell.Width), image.Pt(cell.X, cell.Y+cell.Height+sheetLabelHeight-6),
+				gocv.FontHersheySimplex, 0.4, color.RGBA{R: 48, G: 48, B: 48}, 1)
+		}
+		if "" == files[i] {
+			continue
+		}
+		mat, err := readRendition(files[i])
+		if nil != err {
+			continue
+		}
+		dst := mat
+		if 4 == mat.Channels() {
+			bgr := gocv.NewMat()
+			gocv.CvtColor(*mat, &bgr, gocv.ColorBGRAToBGR)
+			dst = &bgr
+			mat.Close()
+		}
+		fitted, _ := resizeMat(dst, r)
+		dst.Close()
+		// centered in the cell
+		x, y := cell.X+(cell.Width-fitted.Cols())/2, cell.Y+(cell.Height-fitted.Rows())/2
+		region := sheet.Region(image.Rect(x, y, x+fitted.Cols(), y+fitted.Rows()))
+		fitted.CopyTo(&region)
+		region.Close()
+		fitted.Close()
+	}
+
+	params := []int{int(gocv.IMWriteJpegQuality), quality}
+	if ".webp" == ext {
+		params = []int{int(gocv.IMWriteWebpQuality), quality}
+	}
+	buf, err := gocv.IMEncodeWithParams(gocv.FileExt(ext), sheet, params)
+	if nil != err {
+		return nil, err
+	}
+	defer buf.Close()
+	return append([]byte(nil), buf.GetBytes()...), nil
+}
@@ -0,0 +1,194 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gocv.io/x/gocv"
+)
+
+// the long side the crop window is searched at
+const smartCropSide = 256
+
+var (
+	faceMu      sync.Mutex
+	faceCascade *gocv.CascadeClassifier
+	// loaded again by the worker
+	faceCascadeFile string
+)
+
+/**
+ * haar cascade of OpenCV to find the faces kept in smart crops, e.g. haarcascade_frontalface_default.xml
+ */
+func LoadFaceCascade(fileName string) error {
+	classifier := gocv.NewCascadeClassifier()
+	if !classifier.Load(fileName) {
+		classifier.Close()
+		return errors.New("load " + fileName + " failed")
+	}
+	faceMu.Lock()
+	faceCascade = &classifier
+	faceCascadeFile = fileName
+	faceMu.Unlock()
+	return nil
+}
+
+func detectFaces(gray *gocv.Mat) []image.Rectangle {
+	faceMu.Lock()
+	defer faceMu.Unlock()
+	if nil == faceCascade {
+		return nil
+	}
+	return faceCascade.DetectMultiScale(*gray)
+}
+
+/**
+ * scaled down 8 bits gray, nil for the other depths
+ */
+func grayOf(mat *gocv.Mat, scale float64) *gocv.Mat {
+	code := gocv.ColorBGRToGray
+	switch mat.Type() {
+	case gocv.MatTypeCV8U:
+		code = -1
+	case gocv.MatTypeCV8UC3:
+	case gocv.MatTypeCV8UC4:
+		code = gocv.ColorBGRAToGray
+	default:
+		return nil
+	}
+	small := gocv.NewMat()
+	sz := image.Pt(int(math.Max(1, float64(mat.Cols())*scale)), int(math.Max(1, float64(mat.Rows())*scale)))
+	gocv.Resize(*mat, &small, sz, 0, 0, gocv.InterpolationArea)
+	if -1 == code {
+		return &small
+	}
+	defer small.Close()
+	gray := gocv.NewMat()
+	gocv.CvtColor(small, &gray, code)
+	return &gray
+}
+
+/**
+ * gradient energy summed by columns and rows, faces weigh as much as the rest of the image
+ */
+func saliency(gray *gocv.Mat) ([]float64, []float64) {
+	w, h := gray.Cols(), gray.Rows()
+	cols, rows := make([]float64, w), make([]float64, h)
+	data, err := gray.DataPtrUint8()
+	if nil != err || len(data) < w*h {
+		return cols, rows
+	}
+	total := 0.0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			e := math.Abs(float64(data[i+1])-float64(data[i-1])) + math.Abs(float64(data[i+w])-float64(data[i-w]))
+			cols[x] += e
+			rows[y] += e
+			total += e
+		}
+	}
+
+	faces := detectFaces(gray)
+	for _, face := range faces {
+		face = face.Intersect(image.Rect(0, 0, w, h))
+		if face.Empty() {
+			continue
+		}
+		boost := (total + 1) / float64(len(faces))
+		for x := face.Min.X; x < face.Max.X; x++ {
+			cols[x] += boost / float64(face.Dx())
+		}
+		for y := face.Min.Y; y < face.Max.Y; y++ {
+			rows[y] += boost / float64(face.Dy())
+		}
+	}
+	return cols, rows
+}
+
+/**
+ * @return start of the window of length size with the most weight
+ */
+func bestWindow(weights []float64, size int) int {
+	if len(weights) <= size {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range weights[:size] {
+		sum += v
+	}
+	best, bestSum := 0, sum
+	for i := size; i < len(weights); i++ {
+		sum += weights[i] - weights[i-size]
+		if bestSum < sum {
+			best, bestSum = i-size+1, sum
+		}
+	}
+	return best
+}
+
+/**
+ * the cw x ch window keeping the faces, or the most detailed part
+ */
+func smartCrop(mat *gocv.Mat, cw, ch int) image.Rectangle {
+	width, height := mat.Cols(), mat.Rows()
+	x, y := (width-cw)/2, (height-ch)/2
+	scale := math.Min(1, float64(smartCropSide)/math.Max(float64(width), float64(height)))
+	gray := grayOf(mat, scale)
+	if nil != gray {
+		defer gray.Close()
+		cols, rows := saliency(gray)
+		if cw < width {
+			x = int(float64(bestWindow(cols, int(math.Round(float64(cw)*scale)))) / scale)
+			x = int(math.Min(float64(x), float64(width-cw)))
+		}
+		if ch < height {
+			y = int(float64(bestWindow(rows, int(math.Round(float64(ch)*scale)))) / scale)
+			y = int(math.Min(float64(y), float64(height-ch)))
+		}
+	}
+	return image.Rect(x, y, x+cw, y+ch)
+}
+
+/**
+ * the crop box relative to the upright original, as fractions "x,y,w,h", empty when not cropped
+ */
+func cropBox(box image.Rectangle, width, height int) string {
+	if box.Eq(image.Rect(0, 0, width, height)) {
+		return ""
+	}
+	w, h := float64(width), float64(height)
+	return fmt.Sprintf("%.4f,%.4f,%.4f,%.4f",
+		float64(box.Min.X)/w, float64(box.Min.Y)/h, float64(box.Dx())/w, float64(box.Dy())/h)
+}
+
+/**
+ * the box of the fractions of cropBox in a width x height image, the whole when empty or broken
+ */
+func parseCropBox(crop string, width, height int) image.Rectangle {
+	whole := image.Rect(0, 0, width, height)
+	fields := strings.Split(crop, ",")
+	if 4 != len(fields) {
+		return whole
+	}
+	var f [4]float64
+	for i, field := range fields {
+		val, err := strconv.ParseFloat(field, 64)
+		if nil != err {
+			return whole
+		}
+		f[i] = val
+	}
+	w, h := float64(width), float64(height)
+	x, y := int(math.Round(f[0]*w)), int(math.Round(f[1]*h))
+	box := image.Rect(x, y, x+int(math.Round(f[2]*w)), y+int(math.Round(f[3]*h))).Intersect(whole)
+	if box.Empty() {
+		return whole
+	}
+	return box
+}
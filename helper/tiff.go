@@ -0,0 +1,178 @@
+package helper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+type tiffEntry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	raw   [4]byte // value or offset
+}
+
+type tiffFile struct {
+	r     io.ReaderAt
+	base  int64 // offsets are relative to it
+	order binary.ByteOrder
+}
+
+var tiffTypeSize = [...]uint32{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4}
+
+const (
+	tagExifIFD   = 0x8769
+	tagMakerNote = 0x927c
+)
+
+func byteOrder(mark []byte) binary.ByteOrder {
+	switch string(mark) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	default:
+	}
+	return nil
+}
+
+/**
+ * @return reader and offset of IFD0
+ */
+func newTiff(r io.ReaderAt, base int64) (*tiffFile, uint32, error) {
+	var head [8]byte
+	_, err := r.ReadAt(head[:], base)
+	if nil != err {
+		return nil, 0, err
+	}
+	order := byteOrder(head[:2])
+	if nil == order {
+		return nil, 0, errors.New("not a tiff")
+	}
+	return &tiffFile{r: r, base: base, order: order}, order.Uint32(head[4:]), nil
+}
+
+/**
+ * @return entries and offset of the next IFD
+ */
+func (t *tiffFile) readIFD(offset uint32) ([]tiffEntry, uint32, error) {
+	var buf [12]byte
+	pos := t.base + int64(offset)
+	_, err := t.r.ReadAt(buf[:2], pos)
+	if nil != err {
+		return nil, 0, err
+	}
+	count := int(t.order.Uint16(buf[:2]))
+	// a sane IFD never gets that large
+	if 1024 < count {
+		return nil, 0, errors.New("broken ifd")
+	}
+	pos += 2
+	list := make([]tiffEntry, count)
+	for i := 0; i < count; i++ {
+		_, err = t.r.ReadAt(buf[:], pos)
+		if nil != err {
+			return nil, 0, err
+		}
+		entry := &list[i]
+		entry.Tag = t.order.Uint16(buf[0:2])
+		entry.Type = t.order.Uint16(buf[2:4])
+		entry.Count = t.order.Uint32(buf[4:8])
+		copy(entry.raw[:], buf[8:12])
+		pos += 12
+	}
+	_, err = t.r.ReadAt(buf[:4], pos)
+	if nil != err {
+		return list, 0, nil
+	}
+	return list, t.order.Uint32(buf[:4]), nil
+}
+
+func findEntry(list []tiffEntry, tag uint16) *tiffEntry {
+	for i := range list {
+		if tag == list[i].Tag {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+/**
+ * @return offset relative to the base and size of the value
+ */
+func (t *tiffFile) position(entry *tiffEntry) (int64, int64) {
+	siz := int64(0)
+	if int(entry.Type) < len(tiffTypeSize) {
+		siz = int64(tiffTypeSize[entry.Type])
+	}
+	// no wrap around in int64, up to 8 * 4G
+	siz *= int64(entry.Count)
+	if siz <= 4 {
+		return -1, siz
+	}
+	return int64(t.order.Uint32(entry.raw[:])), siz
+}
+
+func (t *tiffFile) bytes(entry *tiffEntry) ([]byte, error) {
+	offset, siz := t.position(entry)
+	if offset < 0 {
+		return entry.raw[:siz], nil
+	}
+	if 1<<24 < siz {
+		return nil, errors.New("tiff value too large")
+	}
+	buf := make([]byte, siz)
+	_, err := t.r.ReadAt(buf, t.base+offset)
+	return buf, err
+}
+
+/**
+ * integer values of SHORT or LONG entries
+ */
+func (t *tiffFile) uints(entry *tiffEntry) []uint32 {
+	buf, err := t.bytes(entry)
+	if nil != err {
+		return nil
+	}
+	width := 0
+	switch entry.Type {
+	case 3, 8:
+		width = 2
+	case 4, 9, 13:
+		width = 4
+	default:
+		return nil
+	}
+	// bounded by the bytes read, never by the count claimed
+	list := make([]uint32, 0, len(buf)/width)
+	for i := 0; i+width <= len(buf); i += width {
+		if 2 == width {
+			list = append(list, uint32(t.order.Uint16(buf[i:])))
+		} else {
+			list = append(list, t.order.Uint32(buf[i:]))
+		}
+	}
+	return list
+}
+
+func (t *tiffFile) uint(entry *tiffEntry) uint32 {
+	list := t.uints(entry)
+	if 0 == len(list) {
+		return 0
+	}
+	return list[0]
+}
+
+func (t *tiffFile) str(entry *tiffEntry) string {
+	buf, err := t.bytes(entry)
+	if nil != err {
+		return ""
+	}
+	for i, c := range buf {
+		if 0 == c {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,84 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// a little endian tiff of one IFD at offset 8, the values follow it
+func testTiff(entries []tiffEntry, values []byte) []byte {
+	buf := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(entries)))
+	for _, entry := range entries {
+		buf = binary.LittleEndian.AppendUint16(buf, entry.Tag)
+		buf = binary.LittleEndian.AppendUint16(buf, entry.Type)
+		buf = binary.LittleEndian.AppendUint32(buf, entry.Count)
+		buf = append(buf, entry.raw[:]...)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, 0)
+	return append(buf, values...)
+}
+
+func TestTiffUints(t *testing.T) {
+	// the values after an IFD of one entry
+	valueOffset := byte(8 + 2 + 12 + 4)
+	cases := []struct {
+		name   string
+		entry  tiffEntry
+		values []byte
+		want   []uint32
+	}{
+		{"inline short", tiffEntry{Tag: 1, Type: 3, Count: 2, raw: [4]byte{6, 0, 7, 0}}, nil, []uint32{6, 7}},
+		{"inline long", tiffEntry{Tag: 1, Type: 4, Count: 1, raw: [4]byte{1, 2, 0, 0}}, nil, []uint32{0x201}},
+		{"offset longs", tiffEntry{Tag: 1, Type: 4, Count: 2, raw: [4]byte{valueOffset}}, []byte{1, 0, 0, 0, 2, 0, 0, 0}, []uint32{1, 2}},
+		{"wrapping count", tiffEntry{Tag: 1, Type: 4, Count: 0x40000001, raw: [4]byte{9, 0, 0, 0}}, nil, nil},
+		{"huge count", tiffEntry{Tag: 1, Type: 3, Count: 0xffffffff, raw: [4]byte{valueOffset}}, nil, nil},
+		{"past the file", tiffEntry{Tag: 1, Type: 4, Count: 100, raw: [4]byte{valueOffset}}, []byte{1, 0, 0, 0}, nil},
+		{"ascii", tiffEntry{Tag: 1, Type: 2, Count: 4, raw: [4]byte{'a', 'b', 'c', 0}}, nil, nil},
+	}
+	for _, c := range cases {
+		tf, ifd0, err := newTiff(bytes.NewReader(testTiff([]tiffEntry{c.entry}, c.values)), 0)
+		if nil != err {
+			t.Fatal(err)
+		}
+		list, _, err := tf.readIFD(ifd0)
+		if nil != err || 1 != len(list) {
+			t.Fatalf("%s: %v %v", c.name, list, err)
+		}
+		got := tf.uints(&list[0])
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v", c.name, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got %v", c.name, got)
+			}
+		}
+	}
+}
+
+func TestTiffPosition(t *testing.T) {
+	tf := &tiffFile{order: binary.LittleEndian}
+	offset, siz := tf.position(&tiffEntry{Type: 4, Count: 0x40000001, raw: [4]byte{8}})
+	if 8 != offset || 4*0x40000001 != siz {
+		t.Errorf("got %d %d", offset, siz)
+	}
+	offset, siz = tf.position(&tiffEntry{Type: 99, Count: 10})
+	if -1 != offset || 0 != siz {
+		t.Errorf("got %d %d", offset, siz)
+	}
+}
+
+func FuzzTiff(f *testing.F) {
+	f.Add(testTiff([]tiffEntry{{Tag: tagOrientation, Type: 3, Count: 1, raw: [4]byte{6}}}, nil))
+	f.Add(testTiff([]tiffEntry{{Tag: tagSubIFDs, Type: 4, Count: 0x40000001, raw: [4]byte{8}}}, nil))
+	f.Add(testTiff([]tiffEntry{{Tag: tagMake, Type: 2, Count: 6, raw: [4]byte{26}}}, []byte("Canon\x00")))
+	f.Fuzz(func(t *testing.T, file []byte) {
+		tiffOrientation(bytes.NewReader(file), 0)
+		tiffPreviews(bytes.NewReader(file))
+		isTiffRaw(bytes.NewReader(file))
+		appleMakerNote(file)
+	})
+}
@@ -0,0 +1,151 @@
+package helper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"gocv.io/x/gocv"
+)
+
+type VideoInfo struct {
+	Width    int
+	Height   int
+	Duration int64 // ms
+}
+
+var videoTypes = map[string]bool{"video/mp4": true, "video/quicktime": true}
+
+func IsVideoType(cType string) bool {
+	return videoTypes[cType]
+}
+
+func IsVideo(fileName string) bool {
+	fp, err := os.Open(fileName)
+	if nil != err {
+		return false
+	}
+	defer fp.Close()
+	brand := FileBrand(fp)
+	return "" != brand && !heifBrands[brand] && !rawBrands[brand]
+}
+
+func mvhdDuration(buf []byte) (int64, error) {
+	var timeScale, duration uint64
+	switch {
+	case 0 == len(buf):
+		return 0, errors.New("broken mvhd")
+	case 0 == buf[0] && 20 <= len(buf):
+		timeScale = uint64(binary.BigEndian.Uint32(buf[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(buf[16:20]))
+	case 1 == buf[0] && 32 <= len(buf):
+		timeScale = uint64(binary.BigEndian.Uint32(buf[20:24]))
+		duration = binary.BigEndian.Uint64(buf[24:32])
+	default:
+		return 0, errors.New("broken mvhd")
+	}
+	if 0 == timeScale {
+		return 0, errors.New("broken mvhd")
+	}
+	// in ms without overflowing, a duration over ages is broken
+	seconds := duration / timeScale
+	if 1<<40 < seconds {
+		return 0, errors.New("broken mvhd")
+	}
+	return int64(seconds*1000 + duration%timeScale*1000/timeScale), nil
+}
+
+/**
+ * @return width and height after the rotation of the display matrix
+ */
+func tkhdSize(buf []byte) (int, int, error) {
+	offset := 40
+	if 1 == buf[0] {
+		offset = 52
+	}
+	if len(buf) < offset+44 {
+		return 0, 0, errors.New("broken tkhd")
+	}
+	matrix := buf[offset : offset+36]
+	width := int(binary.BigEndian.Uint32(buf[offset+36:]) >> 16)
+	height := int(binary.BigEndian.Uint32(buf[offset+40:]) >> 16)
+	// a = d = 0, rotated by 90 or 270 degrees
+	if 0 == binary.BigEndian.Uint32(matrix[0:4]) && 0 == binary.BigEndian.Uint32(matrix[16:20]) {
+		width, height = height, width
+	}
+	return width, height, nil
+}
+
+func handlerType(r io.ReaderAt, trak *Box) string {
+	hdlr, err := FindBoxPath(r, trak.Offset, trak.Offset+trak.Size, "mdia", "hdlr")
+	if nil != err {
+		return ""
+	}
+	buf, err := ReadBox(r, hdlr)
+	if nil != err || len(buf) < 12 {
+		return ""
+	}
+	return string(buf[8:12])
+}
+
+func ReadVideoInfo(r io.ReaderAt) (*VideoInfo, error) {
+	moov, err := FindBoxPath(r, 0, -1, "moov")
+	if nil != err {
+		return nil, err
+	}
+	list, err := ReadBoxes(r, moov.Offset, moov.Offset+moov.Size)
+	if nil != err {
+		return nil, err
+	}
+	buf, err := ReadBox(r, FindBox(list, "mvhd"))
+	if nil != err || 0 == len(buf) {
+		return nil, errors.New("mvhd not found")
+	}
+	info := &VideoInfo{}
+	info.Duration, err = mvhdDuration(buf)
+	if nil != err {
+		return nil, err
+	}
+
+	for i := range list {
+		trak := &list[i]
+		if "trak" != trak.Type || "vide" != handlerType(r, trak) {
+			continue
+		}
+		tkhd, err := FindBoxPath(r, trak.Offset, trak.Offset+trak.Size, "tkhd")
+		if nil == err {
+			buf, err = ReadBox(r, tkhd)
+		}
+		if nil != err || 0 == len(buf) {
+			return nil, errors.New("broken video track")
+		}
+		info.Width, info.Height, err = tkhdSize(buf)
+		return info, err
+	}
+	return nil, errors.New("video track not found")
+}
+
+/**
+ * take the frame at a tenth of the clip, not later than 1s, to skip black leading frames
+ */
+func ReadPoster(fileName string) (*gocv.Mat, error) {
+	vc, err := gocv.VideoCaptureFile(fileName)
+	if nil != err {
+		return nil, err
+	}
+	defer vc.Close()
+
+	pos := vc.Get(gocv.VideoCaptureFrameCount) / 10
+	fps := vc.Get(gocv.VideoCaptureFPS)
+	if 0 < fps && fps < pos {
+		pos = fps
+	}
+	vc.Set(gocv.VideoCapturePosFrames, pos)
+	mat := gocv.NewMat()
+	if !vc.Read(&mat) || mat.Empty() {
+		mat.Close()
+		return nil, errors.New("read poster frame failed")
+	}
+	return &mat, nil
+}
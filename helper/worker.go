@@ -0,0 +1,215 @@
+package helper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	// address space of the worker beyond MaxMemory, for the libraries and the thread stacks
+	workerHeadroom = 2 << 30
+	// the Go runtime exits with it on a fatal signal in a decoder, or out of the address space bounded
+	workerExitCrash = 2
+)
+
+// argv of the worker process, empty to decode in this process
+var workerCmd []string
+
+/**
+ * GenPreview sends with Levels, GenResized with Resize
+ */
+type workerRequest struct {
+	Limits      DecodeLimits
+	Anim        AnimLimits
+	WebPTools   string
+	JXLTools    string
+	FaceCascade string
+	Root        string
+	Src         string
+	Dir         string
+	BaseName    string
+	Ext         string
+	Levels      []Level
+	Resize      *Resize
+}
+
+type workerResponse struct {
+	Preview
+	Err          string
+	Unrenderable bool
+	Timeout      bool
+}
+
+/**
+ * an error reported by the worker, still matching ErrUnrenderable or ErrTimeout
+ */
+type workerError struct {
+	msg          string
+	unrenderable bool
+	timeout      bool
+}
+
+func (e *workerError) Error() string {
+	return e.msg
+}
+
+func (e *workerError) Is(target error) bool {
+	return (e.unrenderable && ErrUnrenderable == target) || (e.timeout && ErrTimeout == target)
+}
+
+/**
+ * decode and encode in a subprocess of argv, e.g. the executable with "worker", so a crash of OpenCV or libheif
+ * takes down only the job. Must be set before serving
+ */
+func SetWorker(argv ...string) {
+	workerCmd = argv
+}
+
+/**
+ * the decode timeout for decoding, and once more for each rendition and each animation,
+ * as the tools of libwebp and libjxl are bounded by it one by one
+ */
+func workerDeadline(req *workerRequest) time.Duration {
+	if nil != req.Resize {
+		return 2 * limits.Timeout
+	}
+	count := 1
+	for i := range req.Levels {
+		count += len(req.Levels[i].Exts())
+		if req.Levels[i].Animated {
+			count++
+		}
+	}
+	return time.Duration(count) * limits.Timeout
+}
+
+/**
+ * how long a job rendering the levels may run, 0 for no bound
+ */
+func JobDeadline(levels []Level) time.Duration {
+	return workerDeadline(&workerRequest{Levels: levels})
+}
+
+/**
+ * one process a job, killed past the deadline of its renditions with ErrTimeout.
+ * A worker crashed marks the original unrenderable, other exits are left to retry
+ */
+func callWorker(req *workerRequest) (*workerResponse, error) {
+	req.Limits = limits
+	req.Anim = animLimits
+	req.WebPTools = webpTools
+	req.JXLTools = jxlTools
+	req.FaceCascade = faceCascadeFile
+	body, err := json.Marshal(req)
+	if nil != err {
+		return nil, err
+	}
+	deadline := workerDeadline(req)
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if 0 < deadline {
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+	}
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, workerCmd[0], workerCmd[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if nil != ctx.Err() {
+		return nil, fmt.Errorf("%w: worker killed after %s", ErrTimeout, deadline)
+	}
+	// a failure to set up, or a kill by the OOM killer, is not the fault of the original
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if workerExitCrash == exitErr.ProcessState.ExitCode() {
+			return nil, fmt.Errorf("%w: worker %s", ErrUnrenderable, exitErr.ProcessState.String())
+		}
+		return nil, errors.New("worker " + exitErr.ProcessState.String())
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	res := &workerResponse{}
+	err = json.Unmarshal(out, res)
+	if nil != err {
+		return nil, err
+	}
+	if "" != res.Err {
+		return nil, &workerError{msg: res.Err, unrenderable: res.Unrenderable, timeout: res.Timeout}
+	}
+	return res, nil
+}
+
+/**
+ * bound the address space by the memory limit, and leave no core of a crash
+ */
+func setWorkerRlimits(l *DecodeLimits) error {
+	err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{})
+	if nil == err && 0 < l.MaxMemory {
+		as := uint64(l.MaxMemory) + workerHeadroom
+		err = syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: as, Max: as})
+	}
+	return err
+}
+
+/**
+ * the worker mode: a request read from in, the response written to out.
+ * An error returned is of setting up, to exit other than workerExitCrash
+ */
+func RunWorker(in io.Reader, out io.Writer) (err error) {
+	res := &workerResponse{}
+	// a panic of ours is reported, so the exit of the runtime is left to the decoders
+	defer func() {
+		if e := recover(); nil != e {
+			res.Err = fmt.Sprintf("%v", e)
+			err = json.NewEncoder(out).Encode(res)
+		}
+	}()
+	req := &workerRequest{}
+	err = json.NewDecoder(in).Decode(req)
+	if nil != err {
+		return err
+	}
+	SetDecodeLimits(req.Limits)
+	SetAnimLimits(req.Anim)
+	SetWebPTools(req.WebPTools)
+	SetJXLTools(req.JXLTools)
+	// not a fault of the original, cropped without faces
+	if "" != req.FaceCascade {
+		if e := LoadFaceCascade(req.FaceCascade); nil != e {
+			fmt.Fprintf(os.Stderr, "face_cascade: %s\n", e.Error())
+		}
+	}
+	err = setWorkerRlimits(&req.Limits)
+	if nil != err {
+		return err
+	}
+
+	if nil == req.Resize {
+		var preview *Preview
+		preview, err = genPreview(req.Root, req.BaseName, req.Ext, req.Levels)
+		if nil == err {
+			res.Preview = *preview
+		}
+	} else {
+		var item *Rendition
+		item, err = genResized(req.Src, req.Dir, req.BaseName, req.Ext, req.Resize)
+		if nil == err {
+			res.List = []Rendition{*item}
+		}
+	}
+	if nil != err {
+		res.Err = err.Error()
+		res.Unrenderable = errors.Is(err, ErrUnrenderable)
+		res.Timeout = errors.Is(err, ErrTimeout)
+	}
+	return json.NewEncoder(out).Encode(res)
+}
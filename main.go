@@ -1,17 +1,177 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/watsonserve/galleried/action"
 	"github.com/watsonserve/galleried/dao"
+	"github.com/watsonserve/galleried/helper"
 	"github.com/watsonserve/galleried/services"
 	"github.com/watsonserve/goengine"
 	"github.com/watsonserve/goutils"
 )
 
+// cache_thumb=31536000
+func getCacheAge(conf map[string][]string, levels []helper.Level) map[string]int {
+	cacheAge := make(map[string]int)
+	levs := []string{"raw", "motion", "derived"}
+	for _, level := range levels {
+		levs = append(levs, level.Name)
+	}
+	for _, lev := range levs {
+		vals := conf["cache_"+lev]
+		if 0 == len(vals) {
+			continue
+		}
+		maxAge, err := strconv.Atoi(vals[0])
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "cache_%s: %s\n", lev, err.Error())
+			continue
+		}
+		cacheAge[lev] = maxAge
+	}
+	return cacheAge
+}
+
+// rendition_size=320x320, one per line
+func getSizes(conf map[string][]string) map[string]bool {
+	sizes := make(map[string]bool)
+	for _, size := range conf["rendition_size"] {
+		sizes[size] = true
+	}
+	return sizes
+}
+
+// rendition_quality=64, one per line
+func getQualities(conf map[string][]string) map[int]bool {
+	qualities := map[int]bool{helper.DefaultQuality: true}
+	for _, val := range conf["rendition_quality"] {
+		quality, err := strconv.Atoi(val)
+		if nil != err || quality < 1 || 100 < quality {
+			fmt.Fprintf(os.Stderr, "rendition_quality: invalid %s\n", val)
+			continue
+		}
+		qualities[quality] = true
+	}
+	return qualities
+}
+
+// rendition=tablet 1600x1600 contain q70, one per line, the defaults when none
+func getLevels(conf map[string][]string) []helper.Level {
+	vals := conf["rendition"]
+	if 0 == len(vals) {
+		return helper.DefaultLevels
+	}
+	levels := make([]helper.Level, 0, len(vals))
+	names := make(map[string]bool)
+	for _, val := range vals {
+		level, err := helper.ParseLevel(val)
+		if nil == err && names[level.Name] {
+			err = errors.New("duplicated " + level.Name)
+		}
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "rendition: %s\n", err.Error())
+			continue
+		}
+		names[level.Name] = true
+		levels = append(levels, *level)
+	}
+	return levels
+}
+
+// job_workers=4, the number of CPUs by default
+func getWorkers(conf map[string][]string) int {
+	vals := conf["job_workers"]
+	if 0 == len(vals) {
+		return runtime.NumCPU()
+	}
+	workers, err := strconv.Atoi(vals[0])
+	if nil != err || workers < 1 {
+		fmt.Fprintf(os.Stderr, "job_workers: invalid %s\n", vals[0])
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// decode_max_pixels=200000000, decode_max_side=65500, decode_max_memory=2048 (MB), decode_timeout=120 (s), 0 for no bound
+func getDecodeLimits(conf map[string][]string) helper.DecodeLimits {
+	limits := helper.DefaultDecodeLimits
+	for _, key := range []string{"decode_max_pixels", "decode_max_side", "decode_max_memory", "decode_timeout"} {
+		vals := conf[key]
+		if 0 == len(vals) {
+			continue
+		}
+		val, err := strconv.ParseInt(vals[0], 10, 64)
+		if nil != err || val < 0 {
+			fmt.Fprintf(os.Stderr, "%s: invalid %s\n", key, vals[0])
+			continue
+		}
+		switch key {
+		case "decode_max_pixels":
+			limits.MaxPixels = val
+		case "decode_max_side":
+			limits.MaxSide = int(val)
+		case "decode_max_memory":
+			limits.MaxMemory = val << 20
+		case "decode_timeout":
+			limits.Timeout = time.Duration(val) * time.Second
+		default:
+		}
+	}
+	return limits
+}
+
+// anim_max_frames=300, anim_max_duration=30 (s) of the animated renditions, 0 for no bound
+func getAnimLimits(conf map[string][]string) helper.AnimLimits {
+	limits := helper.DefaultAnimLimits
+	for _, key := range []string{"anim_max_frames", "anim_max_duration"} {
+		vals := conf[key]
+		if 0 == len(vals) {
+			continue
+		}
+		val, err := strconv.Atoi(vals[0])
+		if nil != err || val < 0 {
+			fmt.Fprintf(os.Stderr, "%s: invalid %s\n", key, vals[0])
+			continue
+		}
+		switch key {
+		case "anim_max_frames":
+			limits.MaxFrames = val
+		case "anim_max_duration":
+			limits.MaxDuration = time.Duration(val) * time.Second
+		default:
+		}
+	}
+	return limits
+}
+
+// cache_budget=50G, bytes of the renditions with an optional K, M, G or T, no bound by default
+func getCacheBudget(conf map[string][]string) int64 {
+	vals := conf["cache_budget"]
+	if 0 == len(vals) || "" == vals[0] {
+		return 0
+	}
+	val := strings.ToUpper(vals[0])
+	unit := int64(1)
+	if i := strings.IndexByte("KMGT", val[len(val)-1]); -1 < i {
+		unit = 1 << (10 * (i + 1))
+		val = val[:len(val)-1]
+	}
+	budget, err := strconv.ParseInt(val, 10, 64)
+	if nil != err || budget < 0 {
+		fmt.Fprintf(os.Stderr, "cache_budget: invalid %s\n", vals[0])
+		return 0
+	}
+	return budget * unit
+}
+
 func main() {
 	optionsInfo := []goutils.Option{
 		{
@@ -29,8 +189,18 @@ func main() {
 			Desc:      "configure filename",
 		},
 	}
-	helpInfo := goutils.GenHelp(optionsInfo, "")
+	optionsInfo = append(optionsInfo, regenOptionsInfo...)
+	helpInfo := goutils.GenHelp(optionsInfo, " [regen | worker | listen]")
 	opts, addr := goutils.GetOptions(optionsInfo)
+	// decoding one original for the server, over stdin and stdout
+	if 0 < len(addr) && "worker" == addr[0] {
+		err := helper.RunWorker(os.Stdin, os.Stdout)
+		if nil != err {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	confFile, hasConf := opts["conf"]
 	if _, hasHelp := opts["help"]; hasHelp {
 		fmt.Println(helpInfo)
@@ -65,19 +235,85 @@ func main() {
 
 	dbi := dao.NewDAO(dbConn)
 
-	listSrv := services.NewListService(dbi, rootDir)
-	fileSrv := services.NewFileService(dbi, rootDir)
+	decodeLimits := getDecodeLimits(conf)
+	helper.SetDecodeLimits(decodeLimits)
+	helper.SetAnimLimits(getAnimLimits(conf))
+	// webp_tools=/usr/bin, where img2webp and anim_dump of libwebp are, $PATH by default
+	if vals := conf["webp_tools"]; 0 < len(vals) {
+		helper.SetWebPTools(vals[0])
+	}
+	// jxl_tools=/usr/bin, where cjxl and djxl of libjxl are, $PATH by default
+	if vals := conf["jxl_tools"]; 0 < len(vals) {
+		helper.SetJXLTools(vals[0])
+	}
+	// sandbox=off to decode in this process
+	if vals := conf["sandbox"]; 0 == len(vals) || "off" != vals[0] {
+		var exe string
+		exe, err = os.Executable()
+		if nil != err {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		helper.SetWorker(exe, "worker")
+	} else if 0 < decodeLimits.Timeout {
+		fmt.Fprintln(os.Stderr, "sandbox=off: a decoding past decode_timeout is given up but keeps running in this process")
+	}
+	levels := getLevels(conf)
+	workers := getWorkers(conf)
+	// face_cascade=/usr/share/opencv4/haarcascades/haarcascade_frontalface_default.xml, kept by the smart crops
+	if vals := conf["face_cascade"]; 0 < len(vals) {
+		err = helper.LoadFaceCascade(vals[0])
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "face_cascade: %s\n", err.Error())
+		}
+	}
+	// jxl_archive=on to recompress the jpeg originals losslessly into jxl once rendered
+	archive := false
+	if vals := conf["jxl_archive"]; 0 < len(vals) && "on" == vals[0] {
+		archive = true
+	}
+	jobSrv := services.NewJobService(dbi, rootDir, levels, workers, archive)
+	err = services.BackfillCTime(dbi, rootDir)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	if 0 < len(addr) && "regen" == addr[0] {
+		var ro *regenOptions
+		ro, err = getRegenOptions(opts, rootDir, workers)
+		if nil == err {
+			err = regen(dbi, jobSrv, ro)
+		}
+		if nil != err {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
-	p := action.NewPictureAction(listSrv, fileSrv)
+	listSrv := services.NewListService(dbi, rootDir, levels)
+	err = jobSrv.Start()
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	services.NewCacheService(dbi, rootDir, getCacheBudget(conf)).Start()
+	fileSrv := services.NewFileService(dbi, rootDir, jobSrv, &services.Options{
+		CacheAge:  getCacheAge(conf, levels),
+		Sizes:     getSizes(conf),
+		Qualities: getQualities(conf),
+		Workers:   workers,
+	})
+	fileSrv.Start()
+	sheetSrv := services.NewSheetService(dbi, rootDir, jobSrv, levels)
+	p := action.NewPictureAction(listSrv, sheetSrv, fileSrv, jobSrv, levels)
 
 	router := goengine.InitHttpRoute()
 	router.StartWith(conf["path_prefix"][0]+"/", p.ServeHTTP)
 	engine := goengine.New(router, sessMgr)
 
 	listen := conf["listen"][0]
-	listen_1 := addr[0]
-	if "" != listen_1 {
-		listen = listen_1
+	if 0 < len(addr) && "" != addr[0] {
+		listen = addr[0]
 	}
 	http.ListenAndServe(listen, engine)
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/watsonserve/galleried/dao"
+	"github.com/watsonserve/galleried/helper"
+	"github.com/watsonserve/galleried/services"
+	"github.com/watsonserve/goutils"
+)
+
+const (
+	regenBatch = 64
+	// before any uuid
+	regenStart = "00000000-0000-0000-0000-000000000000"
+)
+
+type regenOptions struct {
+	filter  dao.RegenFilter
+	missing bool
+	archive bool
+	workers int
+	resume  bool
+	state   string // file keeping the last etag of the batches done
+}
+
+var regenOptionsInfo = []goutils.Option{
+	{Name: "user", Option: "user", HasParams: true, Desc: "regen: only the files of the uid"},
+	{Name: "ext", Option: "ext", HasParams: true, Desc: "regen: only the originals of the extName, e.g. .cr2"},
+	{Name: "since", Option: "since", HasParams: true, Desc: "regen: uploaded since the date, 2006-01-02"},
+	{Name: "until", Option: "until", HasParams: true, Desc: "regen: uploaded until the date, inclusive"},
+	{Name: "missing", Option: "missing", HasParams: false, Desc: "regen: only the levels missing or stale"},
+	{Name: "jobs", Option: "jobs", HasParams: true, Desc: "regen: files in parallel, job_workers by default"},
+	{Name: "resume", Option: "resume", HasParams: false, Desc: "regen: continue after the last batch done"},
+	{Name: "archive", Option: "archive", HasParams: false, Desc: "regen: recompress the jpeg originals into jxl instead, no rendering"},
+	{Name: "state", Option: "state", HasParams: true, Desc: "regen: file of the progress, <root>/.regen by default"},
+}
+
+func parseDate(val string) (int64, error) {
+	date, err := time.ParseInLocation("2006-01-02", val, time.Local)
+	if nil != err {
+		return 0, err
+	}
+	return date.Unix(), nil
+}
+
+func getRegenOptions(opts map[string]string, rootDir string, workers int) (*regenOptions, error) {
+	var err error
+	ro := &regenOptions{
+		filter:  dao.RegenFilter{Uid: opts["user"], Ext: opts["ext"], Until: 1<<31 - 1},
+		workers: workers,
+		state:   path.Join(rootDir, ".regen"),
+	}
+	_, ro.missing = opts["missing"]
+	_, ro.resume = opts["resume"]
+	_, ro.archive = opts["archive"]
+	if "" != ro.filter.Ext && !strings.HasPrefix(ro.filter.Ext, ".") {
+		ro.filter.Ext = "." + ro.filter.Ext
+	}
+	if val := opts["since"]; "" != val {
+		ro.filter.Since, err = parseDate(val)
+	}
+	if val := opts["until"]; nil == err && "" != val {
+		ro.filter.Until, err = parseDate(val)
+		ro.filter.Until += 24 * 3600
+	}
+	if val := opts["jobs"]; nil == err && "" != val {
+		ro.workers, err = strconv.Atoi(val)
+		if nil == err && ro.workers < 1 {
+			err = errors.New("jobs at least 1")
+		}
+	}
+	if val := opts["state"]; "" != val {
+		ro.state = val
+	}
+	return ro, err
+}
+
+/**
+ * regenerate the renditions of the originals matched, batch by batch in the order of etag.
+ * the last etag of each batch done is saved, for --resume
+ */
+func regen(dbi *dao.DBI, jobSrv *services.JobService, ro *regenOptions) error {
+	err := jobSrv.MarkStale()
+	if nil != err {
+		return err
+	}
+	total, err := dbi.RegenCount(&ro.filter)
+	if nil != err {
+		return err
+	}
+	after := regenStart
+	// counted in the progress, not in the summary
+	done := int64(0)
+	if ro.resume {
+		buf, err := os.ReadFile(ro.state)
+		if nil != err {
+			return err
+		}
+		after = strings.TrimSpace(string(buf))
+		done, err = dbi.RegenDone(&ro.filter, after)
+		if nil != err {
+			return err
+		}
+		fmt.Printf("resume after %s, %d done\n", after, done)
+	}
+
+	var mu sync.Mutex
+	count, failed, skipped := done, 0, 0
+	report := func(item *dao.FileMeta, status string) {
+		mu.Lock()
+		defer mu.Unlock()
+		count++
+		fmt.Printf("[%d/%d] %s%s %s\n", count, total, item.Name, item.Ext, status)
+	}
+	sem := make(chan struct{}, ro.workers)
+	for {
+		list, err := dbi.RegenList(&ro.filter, after, regenBatch)
+		if nil != err {
+			return err
+		}
+		if 0 == len(list) {
+			break
+		}
+
+		wg := sync.WaitGroup{}
+		for _, item := range list {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(item *dao.FileMeta) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				if ro.archive {
+					err := jobSrv.Archive(item.Name)
+					if nil != err {
+						mu.Lock()
+						failed++
+						mu.Unlock()
+						report(item, "failed: "+err.Error())
+						return
+					}
+					report(item, "archived")
+					return
+				}
+				levels, err := regenLevels(jobSrv, item.Name, ro.missing)
+				if nil == err && 0 == len(levels) {
+					mu.Lock()
+					skipped++
+					mu.Unlock()
+					report(item, "skipped")
+					return
+				}
+				if nil == err {
+					err = jobSrv.Render(item.Name, levels)
+				}
+				if nil != err {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+					report(item, "failed: "+err.Error())
+					return
+				}
+				report(item, "ok")
+			}(item)
+		}
+		wg.Wait()
+
+		after = list[len(list)-1].Name
+		err = os.WriteFile(ro.state, []byte(after+"\n"), 0660)
+		if nil != err {
+			return err
+		}
+	}
+	fmt.Printf("regenerated %d, skipped %d, failed %d\n", count-done-int64(skipped+failed), skipped, failed)
+	if 0 == failed {
+		os.Remove(ro.state)
+	}
+	return nil
+}
+
+func regenLevels(jobSrv *services.JobService, eTagVal string, missing bool) ([]helper.Level, error) {
+	if missing {
+		return jobSrv.Missing(eTagVal)
+	}
+	return jobSrv.Levels(), nil
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/watsonserve/galleried/dao"
+	"github.com/watsonserve/galleried/helper"
+)
+
+/**
+ * renditions are a cache of the originals, evicted least recently used first when over the budget
+ * and generated again on the next request. Originals are never touched
+ */
+type CacheService struct {
+	rootPath string
+	dbi      *dao.DBI
+	budget   int64 // bytes, 0 for no bound
+}
+
+const (
+	cacheSweepInterval = 10 * time.Minute
+	cacheEvictBatch    = 256
+	// evicted down to, so the budget is not hit again right after
+	cacheLowWater = 0.9
+)
+
+func NewCacheService(dbi *dao.DBI, root string, budget int64) *CacheService {
+	return &CacheService{
+		rootPath: path.Clean(root),
+		dbi:      dbi,
+		budget:   budget,
+	}
+}
+
+func (d *CacheService) Start() {
+	if d.budget < 1 {
+		return
+	}
+	go func() {
+		for {
+			err := d.Sweep()
+			if nil != err {
+				fmt.Fprintf(os.Stderr, "sweep renditions: %s\n", err.Error())
+			}
+			time.Sleep(cacheSweepInterval)
+		}
+	}()
+}
+
+func (d *CacheService) Sweep() error {
+	total, err := d.dbi.CacheSize()
+	if nil != err || total <= d.budget {
+		return err
+	}
+	target := int64(float64(d.budget) * cacheLowWater)
+	count, freed := 0, int64(0)
+	for target < total {
+		list, err := d.dbi.LRURenditions(cacheEvictBatch)
+		if nil != err {
+			return err
+		}
+		if 0 == len(list) {
+			break
+		}
+		for _, entry := range list {
+			if total <= target {
+				break
+			}
+			exts, err := d.dbi.EvictRendition(entry)
+			if nil != err {
+				return err
+			}
+			// used or regenerated since listed
+			if 0 == len(exts) {
+				continue
+			}
+			for _, extName := range exts {
+				err = os.Remove(path.Join(d.rootPath, helper.RenditionDir(entry.Lev), entry.ETag+extName))
+				if nil != err && !os.IsNotExist(err) {
+					fmt.Fprintf(os.Stderr, "evict %s: %s\n", entry.ETag, err.Error())
+				}
+			}
+			total -= entry.Size
+			freed += entry.Size
+			count += len(exts)
+		}
+	}
+	if 0 < count {
+		fmt.Fprintf(os.Stderr, "evicted %d renditions, %d bytes\n", count, freed)
+	}
+	return nil
+}
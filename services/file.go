@@ -1,22 +1,59 @@
 package services
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/watsonserve/galleried/dao"
 	"github.com/watsonserve/galleried/helper"
 )
 
+type Options struct {
+	CacheAge  map[string]int  // max-age in seconds of each lev, for the urls pinned to an etag by ?v=
+	Sizes     map[string]bool // WxH allowed for on-demand renditions, 0 for a free side
+	Qualities map[int]bool
+	Workers   int // on-demand renditions generated at once
+}
+
 type FileService struct {
 	rootPath string
 	dbi      *dao.DBI
+	jobs     *JobService
+	opts     *Options
+	// djxl runs at once restoring archived originals
+	restoreSlots chan struct{}
+	// workers generating on-demand renditions, and the renditions on their way by etag, lev and ext
+	derivedSlots chan struct{}
+	inflightMu   sync.Mutex
+	inflight     map[string]*derivedCall
+}
+
+/**
+ * a rendition generated for the first request, the same requests meanwhile wait for it
+ */
+type derivedCall struct {
+	done chan struct{}
+	file *dao.FileMeta
+	err  error
 }
 
+// no worker is free for an on-demand rendition, to be requested again
+var errBusy = errors.New("Busy")
+
+const (
+	restoreWorkers = 2
+	// a restored jpeg unused for it is removed, the archive is what is kept
+	restoreTTL           = time.Hour
+	restoreSweepInterval = 10 * time.Minute
+)
+
 const (
 	Removed  = 1 // 001
 	Existed  = 3 // 011
@@ -25,11 +62,98 @@ const (
 	ToUpdate = 2 // 010
 )
 
-func NewFileService(dbi *dao.DBI, root string) *FileService {
+func NewFileService(dbi *dao.DBI, root string, jobs *JobService, opts *Options) *FileService {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
 	return &FileService{
 		rootPath: path.Clean(root),
 		dbi:      dbi,
+		jobs:     jobs,
+		opts:     opts,
+
+		restoreSlots: make(chan struct{}, restoreWorkers),
+		derivedSlots: make(chan struct{}, workers),
+		inflight:     make(map[string]*derivedCall),
+	}
+}
+
+/**
+ * remove the restored jpegs unused for restoreTTL
+ */
+func (d *FileService) Start() {
+	go func() {
+		dir := path.Join(d.rootPath, "restored")
+		for {
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if nil == err && restoreTTL < time.Since(info.ModTime()) {
+					os.Remove(path.Join(dir, entry.Name()))
+				}
+			}
+			time.Sleep(restoreSweepInterval)
+		}
+	}()
+}
+
+/**
+ * the jpeg of an archived original, restored once into <root>/restored and shared by the requests till unused
+ */
+func (d *FileService) restore(src, eTagVal string) (*os.File, error) {
+	dir := path.Join(d.rootPath, "restored")
+	dst := path.Join(dir, eTagVal+".jpg")
+	fp, err := os.Open(dst)
+	if os.IsNotExist(err) {
+		d.restoreSlots <- struct{}{}
+		// restored by another request meanwhile
+		fp, err = os.Open(dst)
+		if os.IsNotExist(err) {
+			err = os.MkdirAll(dir, 0770)
+			if nil == err {
+				err = helper.RestoreJPEG(src, dst)
+			}
+			if nil == err {
+				fp, err = os.Open(dst)
+			}
+		}
+		<-d.restoreSlots
+	}
+	if nil != err {
+		return nil, err
+	}
+	now := time.Now()
+	os.Chtimes(dst, now, now)
+	return fp, nil
+}
+
+/**
+ * the uploads recorded with ctime 0 are dated by the mtime of their originals,
+ * for the date ranges of regen and the sheets
+ */
+func BackfillCTime(dbi *dao.DBI, root string) error {
+	ids, list, err := dbi.Undated()
+	if nil != err {
+		return err
 	}
+	count := 0
+	for i, file := range list {
+		stat, err := os.Stat(path.Join(root, "raw", file.Name+file.RawExt()))
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "date %s: %s\n", file.Name, err.Error())
+			continue
+		}
+		err = dbi.SetCTime(ids[i], stat.ModTime().Unix())
+		if nil != err {
+			return err
+		}
+		count++
+	}
+	if 0 < count {
+		fmt.Printf("%d uploads dated\n", count)
+	}
+	return nil
 }
 
 func (d *FileService) checkOption(uid, fileName, ifMatch string) int {
@@ -54,11 +178,6 @@ func (d *FileService) checkOption(uid, fileName, ifMatch string) int {
 	return ToUpdate
 }
 
-func (d *FileService) getLocalFilename(reqPath, baseName, extName string) string {
-	dirPath := path.Base(path.Dir(reqPath))
-	return path.Clean(path.Join(d.rootPath, dirPath, baseName+extName))
-}
-
 func (d *FileService) SendFile(resp http.ResponseWriter, req *http.Request) {
 	uid := helper.GetUid(req)
 	fileName := helper.GetFileName(req.URL.Path)
@@ -73,38 +192,285 @@ func (d *FileService) SendFile(resp http.ResponseWriter, req *http.Request) {
 		StdJSONResp(resp, nil, http.StatusNotFound, "")
 		return
 	}
-	if nil != cachedETag && !cachedETag.W && cachedETag.Value == eTagVal {
+
+	lev := path.Base(path.Dir(req.URL.Path))
+	dir := lev
+	// lev of the rendition in the db
+	renditionLev := lev
+	var file *dao.FileMeta
+	if "derived" == lev {
+		var resize *helper.Resize
+		resize, err = helper.ParseResize(req.URL.Query())
+		if nil == err && !d.allowResize(resize) {
+			err = errors.New("Size Not Allowed")
+		}
+		if nil != err {
+			StdJSONResp(resp, nil, http.StatusBadRequest, err.Error())
+			return
+		}
+		renditionLev = resize.Lev()
+		dir = helper.RenditionDir(renditionLev)
+		file, err = d.derived(resize, eTagVal, &req.Header)
+	} else {
+		file, err = d.fileMeta(uid, lev, eTagVal, &req.Header)
+		if nil != err && "raw" != lev && "motion" != lev {
+			d.pending(resp, req, uid, eTagVal)
+			return
+		}
+		// served as it is till regenerated
+		if nil == err && file.Stale {
+			d.jobs.Require(uid, eTagVal)
+		}
+	}
+	if errors.Is(err, helper.ErrUnrenderable) {
+		StdJSONResp(resp, nil, http.StatusUnprocessableEntity, "Unrenderable")
+		return
+	}
+	// tried again by the next request
+	if errBusy == err || errors.Is(err, helper.ErrTimeout) {
+		respHeader := resp.Header()
+		respHeader.Set("Retry-After", "5")
+		respHeader.Set("Cache-Control", "no-store")
+		StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if nil != err {
+		StdJSONResp(resp, nil, http.StatusNotFound, "")
+		return
+	}
+
+	// renditions are negotiated by Accept, each encoding is a representation of its own
+	repETag := eTagVal
+	respHeader := resp.Header()
+	respHeader.Set("Vary", "Cookie")
+	if "raw" != lev && "motion" != lev {
+		repETag = eTagVal + "-" + strings.TrimPrefix(file.Ext, ".")
+		respHeader.Set("Vary", "Cookie, Accept")
+		// revalidated is used as well
+		if e := d.dbi.TouchRendition(eTagVal, renditionLev, file.Ext, time.Now().Unix()); nil != e {
+			fmt.Fprintf(os.Stderr, "touch %s: %s\n", eTagVal, e.Error())
+		}
+	}
+	if "" != file.Crop {
+		// fractions x,y,w,h of the upright original the rendition was cut from
+		respHeader.Set("X-Crop-Box", file.Crop)
+	}
+	respHeader.Set("ETag", "\""+repETag+"\"")
+	cacheCtl := d.cacheControl(lev, eTagVal, req)
+	if nil != cachedETag && !cachedETag.W && cachedETag.Value == repETag {
+		respHeader.Set("Cache-Control", cacheCtl)
 		resp.WriteHeader(http.StatusNotModified)
 		resp.Write(nil)
 		return
 	}
 
-	absPath := d.getLocalFilename(req.URL.Path, eTagVal, path.Ext(fileName))
+	absPath := path.Join(d.rootPath, dir, file.Name+file.Ext)
+	if "raw" == lev {
+		absPath = path.Join(d.rootPath, dir, file.Name+file.RawExt())
+	}
 	fp, err := os.Open(absPath)
+	// archived meanwhile, the jpeg is gone and the jxl is there
+	if os.IsNotExist(err) && "raw" == lev && !file.Archived {
+		if again, e := d.dbi.Original(eTagVal); nil == e && again.Archived {
+			file = again
+			absPath = path.Join(d.rootPath, dir, file.Name+file.RawExt())
+			fp, err = os.Open(absPath)
+		}
+	}
+	// evicted meanwhile, generated again on the next request
+	if os.IsNotExist(err) && "raw" != lev && "motion" != lev {
+		d.dbi.DropRendition(eTagVal, renditionLev, file.Ext)
+		if "derived" != lev {
+			d.pending(resp, req, uid, eTagVal)
+			return
+		}
+	}
 	if nil != err {
 		StdJSONResp(resp, nil, http.StatusNotFound, err.Error())
 		return
 	}
 	defer fp.Close()
 
-	meta, err := helper.GetMeta(fp)
+	stat, err := fp.Stat()
 	if nil != err {
-		StdJSONResp(resp, nil, http.StatusBadRequest, err.Error())
+		StdJSONResp(resp, nil, http.StatusNotFound, err.Error())
 		return
 	}
+	meta := &helper.Meta{
+		Size:        file.Size,
+		ModTime:     stat.ModTime(),
+		ContentType: file.CType,
+		Sha256Hash:  file.Hash,
+	}
+	if "" == meta.ContentType {
+		meta.ContentType = mime.TypeByExtension(file.Ext)
+	}
 
-	respHeader := resp.Header()
-	respHeader.Set("Vary", "Cookie")
-	respHeader.Set("Content-Type", meta.ContentType)
-	respHeader.Set("Content-Length", fmt.Sprintf("%d", meta.Size))
-	respHeader.Set("Content-Digest", fmt.Sprintf("sha-256=:%s:", meta.Sha256Hash))
-	// respHeader.Set("Last-Modified", meta.ModTime.String())
-	respHeader.Set("ETag", "\""+eTagVal+"\"")
-	if http.MethodHead == req.Method {
+	respHeader.Set("Cache-Control", cacheCtl)
+	respHeader.Set("Last-Modified", meta.ModTime.UTC().Format(http.TimeFormat))
+	// If-None-Match takes precedence
+	if "" == req.Header.Get("If-None-Match") && !helper.ModifiedSince(&req.Header, meta.ModTime) {
+		resp.WriteHeader(http.StatusNotModified)
 		resp.Write(nil)
 		return
 	}
-	io.Copy(resp, fp)
+	// restored bit-exact, the time is of the archive
+	if "raw" == lev && file.Archived {
+		restored, err := d.restore(absPath, eTagVal)
+		if nil != err {
+			StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		defer restored.Close()
+		fp = restored
+	}
+	respHeader.Set("Content-Type", meta.ContentType)
+	respHeader.Set("Content-Digest", fmt.Sprintf("sha-256=:%s:", meta.Sha256Hash))
+	sendContent(resp, req, fp, meta, repETag)
+}
+
+/**
+ * the content of an etag never changes, so urls pinned to the current etag are immutable,
+ * others have to be revalidated; all of them are private to the session
+ */
+func (d *FileService) cacheControl(lev, eTagVal string, req *http.Request) string {
+	maxAge := d.opts.CacheAge[lev]
+	if maxAge < 1 || eTagVal != req.URL.Query().Get("v") {
+		return "private, no-cache"
+	}
+	return fmt.Sprintf("private, max-age=%d, immutable", maxAge)
+}
+
+/**
+ * metadata recorded when the file was created, instead of hashing it on every request
+ */
+func (d *FileService) fileMeta(uid, lev, eTagVal string, reqHeader *http.Header) (*dao.FileMeta, error) {
+	switch lev {
+	case "raw":
+		return d.dbi.Original(eTagVal)
+	case "motion":
+		return d.dbi.Motion(uid, eTagVal)
+	default:
+	}
+	list, err := d.dbi.Renditions(eTagVal, lev)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(list) {
+		return d.recordRendition(lev, eTagVal, ".webp")
+	}
+
+	exts := make([]string, len(list))
+	for i, file := range list {
+		exts[i] = file.Ext
+	}
+	extName := helper.NegotiateFormat(reqHeader, exts)
+	for _, file := range list {
+		if extName == file.Ext {
+			return file, nil
+		}
+	}
+	return list[0], nil
+}
+
+func (d *FileService) allowResize(resize *helper.Resize) bool {
+	return d.opts.Sizes[resize.Size()] && d.opts.Qualities[resize.Quality]
+}
+
+/**
+ * on-demand rendition, generated from the original in the negotiated encoding on the first request.
+ * The same rendition requested meanwhile is generated once
+ */
+func (d *FileService) derived(resize *helper.Resize, eTagVal string, reqHeader *http.Header) (*dao.FileMeta, error) {
+	lev := resize.Lev()
+	extName := helper.NegotiateFormat(reqHeader, helper.RenditionFormats())
+	file, err := d.dbi.Rendition(eTagVal, lev, extName)
+	if nil == err {
+		return file, nil
+	}
+
+	key := eTagVal + "/" + lev + extName
+	d.inflightMu.Lock()
+	call, ok := d.inflight[key]
+	if !ok {
+		call = &derivedCall{done: make(chan struct{}), err: errors.New("rendition failed")}
+		d.inflight[key] = call
+	}
+	d.inflightMu.Unlock()
+	if ok {
+		<-call.done
+		return call.file, call.err
+	}
+	defer func() {
+		d.inflightMu.Lock()
+		delete(d.inflight, key)
+		d.inflightMu.Unlock()
+		close(call.done)
+	}()
+	call.file, call.err = d.genDerived(resize, eTagVal, extName)
+	return call.file, call.err
+}
+
+/**
+ * errBusy when all the workers are taken, the request is not queued
+ */
+func (d *FileService) genDerived(resize *helper.Resize, eTagVal, extName string) (*dao.FileMeta, error) {
+	select {
+	case d.derivedSlots <- struct{}{}:
+	default:
+		return nil, errBusy
+	}
+	defer func() { <-d.derivedSlots }()
+
+	lev := resize.Lev()
+	original, err := d.dbi.Original(eTagVal)
+	if nil != err {
+		return nil, err
+	}
+	if original.Unrenderable {
+		return nil, helper.ErrUnrenderable
+	}
+	dir := path.Join(d.rootPath, "derived", lev)
+	src := path.Join(d.rootPath, "raw", original.Name+original.RawExt())
+	item, err := helper.GenResized(src, dir, eTagVal, extName, resize)
+	// archived meanwhile, the jpeg is gone and the jxl is there
+	if nil != err && !original.Archived {
+		if again, e := d.dbi.Original(eTagVal); nil == e && again.Archived {
+			src = path.Join(d.rootPath, "raw", again.Name+again.RawExt())
+			item, err = helper.GenResized(src, dir, eTagVal, extName, resize)
+		}
+	}
+	if errors.Is(err, helper.ErrUnrenderable) {
+		d.dbi.SetUnrenderable(eTagVal, true)
+	}
+	if nil != err {
+		return nil, err
+	}
+	file := &dao.FileMeta{
+		Name:  eTagVal,
+		Ext:   item.Ext,
+		Hash:  item.Sha256Hash,
+		Size:  item.Size,
+		CType: item.ContentType,
+		Crop:  item.Crop,
+	}
+	return file, d.dbi.InsertRendition(lev, lev, file)
+}
+
+// for renditions generated before their metadata was recorded, by settings unknown
+func (d *FileService) recordRendition(lev, eTagVal, extName string) (*dao.FileMeta, error) {
+	fp, err := os.Open(path.Join(d.rootPath, lev, eTagVal+extName))
+	if nil != err {
+		return nil, err
+	}
+	defer fp.Close()
+
+	meta, err := helper.GetMeta(fp)
+	if nil != err {
+		return nil, err
+	}
+	file := &dao.FileMeta{Name: eTagVal, Ext: extName, Hash: meta.Sha256Hash, Size: meta.Size, CType: meta.ContentType}
+	return file, d.dbi.InsertRendition(lev, "", file)
 }
 
 func (d *FileService) Upload(resp http.ResponseWriter, req *http.Request) {
@@ -121,8 +487,9 @@ func (d *FileService) Upload(resp http.ResponseWriter, req *http.Request) {
 		StdJSONResp(resp, nil, http.StatusUnauthorized, "")
 		return
 	}
-	if !strings.HasPrefix(cType, "image/") {
-		StdJSONResp(resp, nil, http.StatusUnsupportedMediaType, "Accept Image Only")
+	isVideo := helper.IsVideoType(cType)
+	if !isVideo && !strings.HasPrefix(cType, "image/") {
+		StdJSONResp(resp, nil, http.StatusUnsupportedMediaType, "Accept Image Or Video Only")
 		return
 	}
 	if nil == origin {
@@ -147,6 +514,10 @@ func (d *FileService) Upload(resp http.ResponseWriter, req *http.Request) {
 	opt := d.checkOption(uid, fileName, ifMatch)
 	switch opt {
 	case Removed:
+		// the video half of a live photo is matched by its content identifier, known once it is stored
+		if isVideo {
+			break
+		}
 		StdJSONResp(resp, nil, http.StatusGone, "")
 		return
 	case Existed:
@@ -158,28 +529,179 @@ func (d *FileService) Upload(resp http.ResponseWriter, req *http.Request) {
 	default:
 	}
 
-	eTagVal, siz, cTime, err := helper.CreateNewFile(path.Join(d.rootPath, "raw"), path.Ext(fileName), digest, req.Body)
+	extName := path.Ext(fileName)
+	eTagVal, siz, cTime, err := helper.CreateNewFile(path.Join(d.rootPath, "raw"), extName, digest, req.Body)
 	if nil != err {
 		StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
 		return
 	}
 
+	absPath := path.Join(d.rootPath, "raw", eTagVal+extName)
+	thumb := &dao.ResThumb{ETag: eTagVal, Hash: digest, Ext: extName, Size: siz, CType: cType}
+	if isVideo {
+		cid := helper.ContentIdentifier(absPath)
+		if "" != cid {
+			d.keepMotion(resp, uid, ifMatch, absPath, cid, thumb)
+			return
+		}
+		if Removed == opt {
+			os.Remove(absPath)
+			StdJSONResp(resp, nil, http.StatusGone, "")
+			return
+		}
+		err = d.readVideoInfo(absPath, thumb)
+		if nil != err {
+			os.Remove(absPath)
+			StdJSONResp(resp, nil, http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+	} else {
+		thumb.CId = d.pairMotion(uid, absPath, eTagVal)
+	}
+
 	if ToCreate == opt {
-		err = d.dbi.Insert(uid, eTagVal, digest, fileName, siz, cTime)
+		err = d.dbi.Insert(uid, fileName, thumb, cTime)
 	} else {
-		err = d.dbi.Update(uid, eTagVal, digest, fileName, siz)
+		err = d.dbi.Update(uid, fileName, thumb)
 	}
 	if nil != err {
 		StdJSONResp(resp, nil, http.StatusBadRequest, err.Error())
 		return
 	}
+	// the renditions follow in the background, the upload has succeeded anyway
+	job, err := d.jobs.Enqueue(uid, eTagVal)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "enqueue %s: %s\n", eTagVal, err.Error())
+	}
 	origin.Path = req.URL.Path[4:]
 	respHeader := resp.Header()
 	respHeader.Set("Location", origin.String())
 	respHeader.Set("ETag", "\""+eTagVal+"\"")
+	StdJSONResp(resp, job, http.StatusCreated, "")
+}
+
+/**
+ * the rendition is on its way, or has failed
+ */
+func (d *FileService) pending(resp http.ResponseWriter, req *http.Request, uid, eTagVal string) {
+	job, err := d.jobs.Require(uid, eTagVal)
+	if nil != err {
+		StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if dao.JobFailed == job.Status {
+		if original, err := d.dbi.Original(eTagVal); nil == err && original.Unrenderable {
+			StdJSONResp(resp, job, http.StatusUnprocessableEntity, "Unrenderable")
+			return
+		}
+		StdJSONResp(resp, job, http.StatusNotFound, "Rendition Failed")
+		return
+	}
+	respHeader := resp.Header()
+	respHeader.Set("Location", jobLocation(req, job.Id))
+	respHeader.Set("Retry-After", "5")
+	respHeader.Set("Cache-Control", "no-store")
+	StdJSONResp(resp, job, http.StatusAccepted, "Pending")
+}
+
+/**
+ * the video half of a live photo is kept as a companion of the user, found by the content identifier.
+ * If-Match replaces the one uploaded before, like a still
+ */
+func (d *FileService) keepMotion(resp http.ResponseWriter, uid, ifMatch, absPath, cid string, thumb *dao.ResThumb) {
+	existed, err := d.dbi.MotionByCId(uid, cid)
+	status := 0
+	switch {
+	case nil != err && "" != ifMatch:
+		status = http.StatusGone
+	case nil == err && "" == ifMatch:
+		status = http.StatusForbidden
+	case nil == err && ifMatch != existed.Name:
+		status = http.StatusPreconditionFailed
+	default:
+	}
+	if 0 != status {
+		os.Remove(absPath)
+		msg := ""
+		if http.StatusForbidden == status {
+			msg = "Existed"
+		}
+		StdJSONResp(resp, nil, status, msg)
+		return
+	}
+
+	motionPath := path.Join(d.rootPath, "motion", thumb.ETag+thumb.Ext)
+	err = os.Rename(absPath, motionPath)
+	if nil != err {
+		StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	motion := &dao.FileMeta{
+		Name:  thumb.ETag,
+		Ext:   thumb.Ext,
+		Hash:  thumb.Hash,
+		Size:  thumb.Size,
+		CType: thumb.CType,
+	}
+	if nil == existed {
+		err = d.dbi.InsertMotion(uid, cid, motion)
+	} else {
+		err = d.dbi.UpdateMotion(uid, cid, motion)
+	}
+	if nil != err {
+		os.Remove(motionPath)
+		StdJSONResp(resp, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+	if nil != existed {
+		os.Remove(path.Join(d.rootPath, "motion", existed.Name+existed.Ext))
+	}
+	resp.Header().Set("ETag", "\""+thumb.ETag+"\"")
 	StdJSONResp(resp, nil, http.StatusCreated, "")
 }
 
+func (d *FileService) readVideoInfo(absPath string, thumb *dao.ResThumb) error {
+	fp, err := os.Open(absPath)
+	if nil != err {
+		return err
+	}
+	defer fp.Close()
+
+	info, err := helper.ReadVideoInfo(fp)
+	if nil != err {
+		return err
+	}
+	thumb.Width = info.Width
+	thumb.Height = info.Height
+	thumb.Duration = info.Duration
+	return nil
+}
+
+/**
+ * link the still to its motion part, by apple content identifier or the video embedded in it
+ * @return content identifier
+ */
+func (d *FileService) pairMotion(uid, absPath, eTagVal string) string {
+	cid := helper.ContentIdentifier(absPath)
+	if "" != cid {
+		return cid
+	}
+	motion, digest, siz, err := helper.ExtractMotionPhoto(absPath, path.Join(d.rootPath, "motion"))
+	if nil != err {
+		return ""
+	}
+	// an embedded video belongs to this still only
+	err = d.dbi.InsertMotion(uid, eTagVal, &dao.FileMeta{Name: motion, Ext: ".mp4", Hash: digest, Size: siz, CType: "video/mp4"})
+	if nil != err {
+		os.Remove(path.Join(d.rootPath, "motion", motion+".mp4"))
+		return ""
+	}
+	return eTagVal
+}
+
+/**
+ * generate the renditions in the background, poll the job at Location
+ */
 func (d *FileService) GenPreview(resp http.ResponseWriter, req *http.Request) {
 	fileName := helper.GetFileName(req.URL.Path)
 	uid := helper.GetUid(req)
@@ -194,12 +716,13 @@ func (d *FileService) GenPreview(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = helper.GenPreview(d.rootPath, eTagVal, path.Ext(fileName))
+	job, err := d.jobs.Enqueue(uid, eTagVal)
 	if nil != err {
-		StdJSONResp(resp, nil, http.StatusNotFound, err.Error())
+		StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
 		return
 	}
-	StdJSONResp(resp, nil, http.StatusCreated, "")
+	resp.Header().Set("Location", jobLocation(req, job.Id))
+	StdJSONResp(resp, job, http.StatusAccepted, "")
 }
 
 func (d *FileService) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,30 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/watsonserve/galleried/helper"
+)
+
+func TestAllowResize(t *testing.T) {
+	d := NewFileService(nil, "/tmp", nil, &Options{
+		Sizes:     map[string]bool{"320x320": true, "0x240": true},
+		Qualities: map[int]bool{helper.DefaultQuality: true, 80: true},
+	})
+	cases := []struct {
+		resize helper.Resize
+		want   bool
+	}{
+		{helper.Resize{Width: 320, Height: 320, Quality: helper.DefaultQuality}, true},
+		{helper.Resize{Width: 0, Height: 240, Quality: 80}, true},
+		{helper.Resize{Width: 320, Height: 320, Quality: 50}, false},
+		{helper.Resize{Width: 320, Height: 321, Quality: 80}, false},
+		{helper.Resize{Width: 240, Height: 0, Quality: 80}, false},
+		{helper.Resize{Width: 100000, Height: 100000, Quality: 80}, false},
+	}
+	for _, c := range cases {
+		if got := d.allowResize(&c.resize); got != c.want {
+			t.Errorf("%s q%d: got %v", c.resize.Size(), c.resize.Quality, got)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/watsonserve/galleried/dao"
+	"github.com/watsonserve/galleried/helper"
+)
+
+type JobService struct {
+	rootPath string
+	dbi      *dao.DBI
+	levels   []helper.Level
+	workers  int
+	archive  bool // recompress the jpeg originals losslessly into jxl once rendered
+	wake     chan struct{}
+}
+
+const (
+	jobMaxAttempts  = 5
+	jobBackoff      = 30 // seconds before the 2nd attempt, doubled after each failure
+	jobBackoffMax   = 3600
+	jobPollInterval = 10 * time.Second
+	// a job running past its deadline by it is of a process gone
+	jobResetMargin   = time.Minute
+	jobResetInterval = time.Minute
+	// without a decode timeout
+	jobRunningMax = time.Hour
+)
+
+func NewJobService(dbi *dao.DBI, root string, levels []helper.Level, workers int, archive bool) *JobService {
+	if workers < 1 {
+		workers = 1
+	}
+	return &JobService{
+		rootPath: path.Clean(root),
+		dbi:      dbi,
+		levels:   levels,
+		workers:  workers,
+		archive:  archive,
+		wake:     make(chan struct{}, workers),
+	}
+}
+
+/**
+ * renditions of the levels whose settings have changed are stale,
+ * those in the formats removed from the config are removed. An encoder not found this time removes nothing
+ */
+func (d *JobService) MarkStale() error {
+	for i := range d.levels {
+		level := &d.levels[i]
+		dropped, err := d.dbi.DropEncodings(level.Name, level.Configured())
+		if nil != err {
+			return err
+		}
+		for _, file := range dropped {
+			os.Remove(path.Join(d.rootPath, level.Name, file.Name+file.Ext))
+		}
+		if 0 < len(dropped) {
+			fmt.Printf("%s: %d renditions dropped\n", level.Name, len(dropped))
+		}
+		// the animated flag changes nothing of a still
+		toggled := *level
+		toggled.Animated = !level.Animated
+		count, err := d.dbi.MarkStale(level.Name, level.Sig(), toggled.Sig())
+		if nil != err {
+			return err
+		}
+		if 0 < count {
+			fmt.Printf("%s: %d renditions stale\n", level.Name, count)
+		}
+	}
+	return nil
+}
+
+/**
+ * start the bounded worker pool, jobs left running by a process gone are queued again
+ */
+func (d *JobService) Start() error {
+	err := d.MarkStale()
+	if nil == err {
+		err = d.resetJobs()
+	}
+	if nil != err {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(jobResetInterval)
+			if e := d.resetJobs(); nil != e {
+				fmt.Fprintf(os.Stderr, "reset jobs: %s\n", e.Error())
+			}
+		}
+	}()
+	for i := 0; i < d.workers; i++ {
+		go d.work()
+	}
+	return nil
+}
+
+/**
+ * jobs running past the deadline of their worker, those of other processes on the db are left alone
+ */
+func (d *JobService) resetJobs() error {
+	deadline := helper.JobDeadline(d.levels)
+	if deadline <= 0 {
+		deadline = jobRunningMax
+	}
+	count, err := d.dbi.ResetJobs(time.Now().Add(-deadline - jobResetMargin).Unix())
+	if nil == err && 0 < count {
+		fmt.Printf("%d jobs queued again\n", count)
+	}
+	return err
+}
+
+/**
+ * @return the unfinished job of the etag, or a new one
+ */
+func (d *JobService) Enqueue(uid, eTagVal string) (*dao.Job, error) {
+	id, err := helper.GenUUIDStr()
+	if nil != err {
+		return nil, err
+	}
+	// queued by a request alongside, or finished between the insert and the select, then tried once more
+	for i := 0; i < 2; i++ {
+		job, err := d.dbi.InsertJob(id, uid, eTagVal, time.Now().Unix())
+		if nil == err {
+			select {
+			case d.wake <- struct{}{}:
+			default:
+			}
+			return job, nil
+		}
+		if sql.ErrNoRows != err {
+			return nil, err
+		}
+		job, err = d.dbi.PendingJob(eTagVal)
+		if sql.ErrNoRows != err {
+			return job, err
+		}
+	}
+	return nil, errors.New("job of " + eTagVal + " not queued")
+}
+
+/**
+ * for a rendition not found: the last job, unless it is done, then a new one
+ */
+func (d *JobService) Require(uid, eTagVal string) (*dao.Job, error) {
+	job, err := d.dbi.LastJob(uid, eTagVal)
+	if nil == err && dao.JobDone != job.Status {
+		return job, nil
+	}
+	if nil != err && sql.ErrNoRows != err {
+		return nil, err
+	}
+	return d.Enqueue(uid, eTagVal)
+}
+
+func (d *JobService) work() {
+	for {
+		job, err := d.dbi.ClaimJob(time.Now().Unix())
+		if nil != err {
+			if sql.ErrNoRows != err {
+				fmt.Fprintf(os.Stderr, "claim job: %s\n", err.Error())
+			}
+			select {
+			case <-d.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		d.finish(job, d.run(job))
+	}
+}
+
+/**
+ * only the levels missing or stale, a job queued again by a request renders nothing twice
+ */
+func (d *JobService) run(job *dao.Job) error {
+	levels, err := d.Missing(job.ETag)
+	if nil != err || 0 == len(levels) {
+		return err
+	}
+	return d.Render(job.ETag, levels)
+}
+
+/**
+ * generate and record the renditions of the levels
+ */
+func (d *JobService) Render(eTagVal string, levels []helper.Level) (err error) {
+	// a broken original must not take the worker down
+	defer func() {
+		if e := recover(); nil != e {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	original, err := d.dbi.Original(eTagVal)
+	if nil != err {
+		return err
+	}
+	preview, err := helper.GenPreview(d.rootPath, eTagVal, original.RawExt(), levels)
+	if errors.Is(err, helper.ErrUnrenderable) {
+		if e := d.dbi.SetUnrenderable(eTagVal, true); nil != e {
+			fmt.Fprintf(os.Stderr, "mark %s unrenderable: %s\n", eTagVal, e.Error())
+		}
+	}
+	if nil != err {
+		return err
+	}
+	// rendered by the limits raised since
+	if original.Unrenderable {
+		err = d.dbi.SetUnrenderable(eTagVal, false)
+		if nil != err {
+			return err
+		}
+	}
+	if "" != preview.BlurHash {
+		err = d.dbi.SetBlurHash(eTagVal, preview.BlurHash)
+		if nil != err {
+			return err
+		}
+	}
+	if 0 < len(preview.Palette) {
+		err = d.dbi.SetPalette(eTagVal, preview.Palette)
+		if nil != err {
+			return err
+		}
+	}
+	err = d.dbi.SetAnimated(eTagVal, preview.Animated)
+	if nil != err {
+		return err
+	}
+	for _, item := range preview.List {
+		err = d.dbi.InsertRendition(item.Lev, item.Sig, &dao.FileMeta{
+			Name:  eTagVal,
+			Ext:   item.Ext,
+			Hash:  item.Sha256Hash,
+			Size:  item.Size,
+			CType: item.ContentType,
+			Crop:  item.Crop,
+		})
+		if nil != err {
+			return err
+		}
+	}
+	// kept as it is when it can't be restored bit-exact, the renditions are done anyway
+	if d.archive {
+		if e := d.Archive(eTagVal); nil != e {
+			fmt.Fprintf(os.Stderr, "archive %s: %s\n", eTagVal, e.Error())
+		}
+	}
+	return nil
+}
+
+/**
+ * recompress a jpeg original losslessly into jxl, the jpeg is removed once the archive is recorded.
+ * Other originals are left alone
+ */
+func (d *JobService) Archive(eTagVal string) error {
+	original, err := d.dbi.Original(eTagVal)
+	if nil != err || original.Archived {
+		return err
+	}
+	src := path.Join(d.rootPath, "raw", original.Name+original.Ext)
+	fp, err := os.Open(src)
+	if os.IsNotExist(err) {
+		// archived and removed since it was read
+		if again, e := d.dbi.Original(eTagVal); nil == e && again.Archived {
+			return nil
+		}
+	}
+	if nil != err {
+		return err
+	}
+	isJPEG := helper.IsJPEG(fp)
+	fp.Close()
+	if !isJPEG {
+		return nil
+	}
+	err = helper.ArchiveJPEG(src, src+helper.ArchiveExt, original.Hash)
+	if nil != err {
+		// archived by a render or a regen running alongside
+		if again, e := d.dbi.Original(eTagVal); nil == e && again.Archived {
+			return nil
+		}
+		return err
+	}
+	err = d.dbi.SetArchived(eTagVal, true)
+	if nil != err {
+		return err
+	}
+	err = os.Remove(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *JobService) Levels() []helper.Level {
+	return d.levels
+}
+
+/**
+ * levels without a fresh rendition in each of their formats
+ */
+func (d *JobService) Missing(eTagVal string) ([]helper.Level, error) {
+	missing := make([]helper.Level, 0)
+	for _, level := range d.levels {
+		list, err := d.dbi.Renditions(eTagVal, level.Name)
+		if nil != err {
+			return nil, err
+		}
+		fresh := make(map[string]bool)
+		for _, file := range list {
+			fresh[file.Ext] = !file.Stale
+		}
+		for _, ext := range level.Exts() {
+			if !fresh[ext] {
+				missing = append(missing, level)
+				break
+			}
+		}
+	}
+	return missing, nil
+}
+
+func (d *JobService) finish(job *dao.Job, err error) {
+	now := time.Now().Unix()
+	if nil == err {
+		err = d.dbi.FinishJob(job.Id, dao.JobDone, "", now)
+	} else if job.Attempts < jobMaxAttempts && !errors.Is(err, helper.ErrUnrenderable) {
+		fmt.Fprintf(os.Stderr, "job %s attempt %d: %s\n", job.Id, job.Attempts, err.Error())
+		backoff := int64(jobBackoff) << (job.Attempts - 1)
+		if jobBackoffMax < backoff {
+			backoff = jobBackoffMax
+		}
+		err = d.dbi.RetryJob(job.Id, err.Error(), now, now+backoff)
+	} else {
+		fmt.Fprintf(os.Stderr, "job %s failed: %s\n", job.Id, err.Error())
+		// still timed out on the last attempt, not the fault of a busy host only
+		if errors.Is(err, helper.ErrTimeout) {
+			if e := d.dbi.SetUnrenderable(job.ETag, true); nil != e {
+				fmt.Fprintf(os.Stderr, "mark %s unrenderable: %s\n", job.ETag, e.Error())
+			}
+		}
+		err = d.dbi.FinishJob(job.Id, dao.JobFailed, err.Error(), now)
+	}
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "finish job %s: %s\n", job.Id, err.Error())
+	}
+}
+
+/**
+ * the url to poll the job, RequestURI is the one before the rewriting of PictureAction
+ */
+func jobLocation(req *http.Request, id string) string {
+	return strings.SplitN(req.RequestURI, "?", 2)[0] + "?job=" + id
+}
+
+func (d *JobService) Status(resp http.ResponseWriter, req *http.Request) {
+	uid := helper.GetUid(req)
+	if "" == uid {
+		StdJSONResp(resp, nil, http.StatusUnauthorized, "")
+		return
+	}
+	job, err := d.dbi.Job(uid, req.URL.Query().Get("job"))
+	if nil != err {
+		StdJSONResp(resp, nil, http.StatusNotFound, "")
+		return
+	}
+	StdJSONResp(resp, job, 0, "")
+}
+
+func (d *JobService) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodHead:
+		fallthrough
+	case http.MethodGet:
+		d.Status(resp, req)
+		return
+	default:
+	}
+	StdJSONResp(resp, nil, http.StatusMethodNotAllowed, "")
+}
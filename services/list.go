@@ -1,22 +1,33 @@
 package services
 
 import (
+	"math"
 	"net/http"
 	"path"
+	"strconv"
 
 	"github.com/watsonserve/galleried/dao"
 	"github.com/watsonserve/galleried/helper"
 )
 
+// CIELAB distance of a colour search when not given, about what is told apart at a glance
+const defaultColorDistance = 20
+
 type ListService struct {
-	raw string
-	dbi *dao.DBI
+	raw    string
+	dbi    *dao.DBI
+	levels map[string]bool
 }
 
-func NewListService(dbi *dao.DBI, root string) *ListService {
+func NewListService(dbi *dao.DBI, root string, levels []helper.Level) *ListService {
+	names := make(map[string]bool)
+	for _, level := range levels {
+		names[level.Name] = true
+	}
 	return &ListService{
-		raw: path.Clean(path.Join(root, "raw")),
-		dbi: dbi,
+		raw:    path.Clean(path.Join(root, "raw")),
+		dbi:    dbi,
+		levels: names,
 	}
 }
 
@@ -27,12 +38,39 @@ func (d *ListService) List(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	rangeList := helper.GetRange(&req.Header)
-	list, err := d.dbi.List(uid, rangeList)
+	var list []dao.ResUserImg
+	var swatch *helper.Swatch
+	var err error
+	query := req.URL.Query()
+	if color := query.Get("color"); "" != color {
+		swatch, err = helper.ParseColor(color)
+		distance := float64(defaultColorDistance)
+		if nil == err && "" != query.Get("distance") {
+			distance, err = strconv.ParseFloat(query.Get("distance"), 64)
+		}
+		if nil != err || !(0 < distance) || math.IsInf(distance, 0) {
+			StdJSONResp(resp, nil, http.StatusBadRequest, "invalid color or distance")
+			return
+		}
+		list, err = d.dbi.ColorSearch(uid, swatch, distance, rangeList)
+	} else {
+		list, err = d.dbi.List(uid, rangeList)
+	}
 
 	if nil != err {
 		StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
 		return
 	}
+	// leave out on-demand sizes and the levels not configured any more
+	for i := range list {
+		levs := list[i].Levs[:0]
+		for _, lev := range list[i].Levs {
+			if d.levels[lev] {
+				levs = append(levs, lev)
+			}
+		}
+		list[i].Levs = levs
+	}
 	StdJSONResp(resp, list, 0, "")
 }
 
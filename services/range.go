@@ -0,0 +1,130 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/watsonserve/galleried/helper"
+)
+
+type countWriter int64
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	*w += countWriter(len(p))
+	return len(p), nil
+}
+
+func contentRange(seg *helper.Segment, size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", seg.Start, seg.End, size)
+}
+
+/**
+ * write the parts of multipart/byteranges, headers only when body is false
+ */
+func writeParts(mw *multipart.Writer, fp *os.File, rangeList []helper.Segment, meta *helper.Meta, body bool) error {
+	for i := range rangeList {
+		seg := &rangeList[i]
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {meta.ContentType},
+			"Content-Range": {contentRange(seg, meta.Size)},
+		})
+		if nil != err || !body {
+			continue
+		}
+		_, err = fp.Seek(seg.Start, io.SeekStart)
+		if nil == err {
+			_, err = io.CopyN(part, fp, seg.End-seg.Start+1)
+		}
+		if nil != err {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func sendMultiRange(resp http.ResponseWriter, req *http.Request, fp *os.File, rangeList []helper.Segment, meta *helper.Meta) {
+	// count the length first, so that clients can show the progress
+	var siz countWriter
+	counter := multipart.NewWriter(&siz)
+	writeParts(counter, fp, rangeList, meta, false)
+	for _, seg := range rangeList {
+		siz += countWriter(seg.End - seg.Start + 1)
+	}
+
+	respHeader := resp.Header()
+	respHeader.Set("Content-Type", "multipart/byteranges; boundary="+counter.Boundary())
+	respHeader.Set("Content-Length", fmt.Sprintf("%d", siz))
+	resp.WriteHeader(http.StatusPartialContent)
+	if http.MethodHead == req.Method {
+		return
+	}
+	mw := multipart.NewWriter(resp)
+	mw.SetBoundary(counter.Boundary())
+	writeParts(mw, fp, rangeList, meta, true)
+}
+
+// ranges overlapping to more than the file are sent as the whole
+func tooManyRanges(rangeList []helper.Segment, size int64) bool {
+	total := int64(0)
+	for _, seg := range helper.ResolveRange(rangeList, size) {
+		total += seg.End - seg.Start + 1
+	}
+	return 1 < len(rangeList) && size < total
+}
+
+/**
+ * send the whole file, a single range, or multipart/byteranges
+ */
+func sendContent(resp http.ResponseWriter, req *http.Request, fp *os.File, meta *helper.Meta, eTagVal string) {
+	respHeader := resp.Header()
+	respHeader.Set("Accept-Ranges", "bytes")
+
+	var rangeList []helper.Segment
+	if strings.HasPrefix(req.Header.Get("Range"), "bytes=") && helper.CheckIfRange(&req.Header, eTagVal, meta.ModTime) {
+		rangeList = helper.GetRange(&req.Header)
+	}
+	if nil == rangeList || tooManyRanges(rangeList, meta.Size) {
+		respHeader.Set("Content-Length", fmt.Sprintf("%d", meta.Size))
+		if http.MethodHead == req.Method {
+			resp.Write(nil)
+			return
+		}
+		io.Copy(resp, fp)
+		return
+	}
+
+	rangeList = helper.ResolveRange(rangeList, meta.Size)
+	if 0 == len(rangeList) {
+		respHeader.Del("Content-Digest")
+		respHeader.Set("Content-Range", fmt.Sprintf("bytes */%d", meta.Size))
+		StdJSONResp(resp, nil, http.StatusRequestedRangeNotSatisfiable, "")
+		return
+	}
+
+	// the digest is of the whole representation, not of the parts
+	respHeader.Del("Content-Digest")
+	respHeader.Set("Repr-Digest", fmt.Sprintf("sha-256=:%s:", meta.Sha256Hash))
+	if 1 < len(rangeList) {
+		sendMultiRange(resp, req, fp, rangeList, meta)
+		return
+	}
+
+	seg := &rangeList[0]
+	length := seg.End - seg.Start + 1
+	respHeader.Set("Content-Range", contentRange(seg, meta.Size))
+	respHeader.Set("Content-Length", fmt.Sprintf("%d", length))
+	resp.WriteHeader(http.StatusPartialContent)
+	if http.MethodHead == req.Method {
+		return
+	}
+	// keep *os.File under the limit reader, so it can still go by sendfile
+	_, err := fp.Seek(seg.Start, io.SeekStart)
+	if nil == err {
+		io.CopyN(resp, fp, length)
+	}
+}
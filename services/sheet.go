@@ -0,0 +1,293 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/watsonserve/galleried/dao"
+	"github.com/watsonserve/galleried/helper"
+)
+
+/**
+ * contact sheets for proofing and sprite sheets for scrubbing, drawn from the renditions of a level
+ */
+type SheetService struct {
+	rootPath string
+	dbi      *dao.DBI
+	jobs     *JobService
+	levels   map[string]bool
+}
+
+const (
+	sheetMaxItems = 400
+	sheetMaxCols  = 32
+	sheetMinCell  = 16
+	sheetMaxCell  = 320
+	sheetQuality  = 80
+	// the largest side webp can encode
+	sheetMaxSide = 16383
+)
+
+type sheetOptions struct {
+	kind  string // contact, sprite, or map for the cells of the sprite
+	lev   string
+	cols  int
+	cell  int
+	fit   string
+	names []string
+	album string // prefix of the filenames, e.g. "2024-paris-"
+	since int64
+	until int64 // exclusive
+	limit int   // the items fitting in the sides
+	// the Layout of the map the sprite must match, from ?layout=
+	layout string
+}
+
+/**
+ * the cells of a sprite, and the assets left out for their renditions are still pending.
+ * Layout is passed with the sprite, which is refused once drawn from other renditions
+ */
+type SheetMap struct {
+	helper.SheetLayout
+	Layout  string
+	Missing []string
+}
+
+func NewSheetService(dbi *dao.DBI, root string, jobs *JobService, levels []helper.Level) *SheetService {
+	names := make(map[string]bool)
+	for _, level := range levels {
+		names[level.Name] = true
+	}
+	return &SheetService{
+		rootPath: path.Clean(root),
+		dbi:      dbi,
+		jobs:     jobs,
+		levels:   names,
+	}
+}
+
+func parseSheetDate(val string) (int64, error) {
+	date, err := time.ParseInLocation("2006-01-02", val, time.Local)
+	if nil != err {
+		return 0, errors.New("invalid date " + val)
+	}
+	return date.Unix(), nil
+}
+
+/**
+ * ?sheet=contact|sprite|map&name=a.jpg&name=b.jpg, or &album=&since=2006-01-02&until=2006-01-02,
+ * &lev=thumb&cols=&cell=&fit=contain|cover, &layout= of the map for a sprite
+ */
+func (d *SheetService) parseOptions(req *http.Request) (*sheetOptions, error) {
+	var err error
+	query := req.URL.Query()
+	so := &sheetOptions{kind: query.Get("sheet"), lev: query.Get("lev"), fit: query.Get("fit"), names: query["name"], until: 1<<31 - 1}
+	so.album = query.Get("album")
+	so.layout = query.Get("layout")
+	cols, cell := 10, 160
+	switch so.kind {
+	case "contact":
+		cols, cell = 6, 240
+	case "sprite":
+	case "map":
+	default:
+		return nil, errors.New("invalid sheet")
+	}
+	if "" == so.lev {
+		so.lev = "thumb"
+	}
+	if !d.levels[so.lev] {
+		return nil, errors.New("invalid lev")
+	}
+	if "" == so.fit {
+		so.fit = "contain"
+	}
+	if "contain" != so.fit && "cover" != so.fit {
+		return nil, errors.New("invalid fit")
+	}
+	if val := query.Get("cols"); "" != val {
+		cols, err = strconv.Atoi(val)
+		if nil != err || cols < 1 || sheetMaxCols < cols {
+			return nil, errors.New("invalid cols")
+		}
+	}
+	if val := query.Get("cell"); "" != val {
+		cell, err = strconv.Atoi(val)
+		if nil != err || cell < sheetMinCell || sheetMaxCell < cell {
+			return nil, errors.New("invalid cell")
+		}
+	}
+	so.cols, so.cell = cols, cell
+	so.limit = min(sheetMaxItems, helper.SheetCapacity(cols, cell, "contact" == so.kind, sheetMaxSide))
+
+	since, until := query.Get("since"), query.Get("until")
+	if 0 == len(so.names) && "" == so.album && "" == since && "" == until {
+		return nil, errors.New("name, album, since or until required")
+	}
+	if 0 < len(so.names) && "" != so.album {
+		return nil, errors.New("name and album are exclusive")
+	}
+	if so.limit < len(so.names) {
+		return nil, fmt.Errorf("at most %d names in %d cols of %d", so.limit, cols, cell)
+	}
+	if "" != since {
+		so.since, err = parseSheetDate(since)
+	}
+	if nil == err && "" != until {
+		so.until, err = parseSheetDate(until)
+		so.until += 24 * 3600
+	}
+	return so, err
+}
+
+/**
+ * the explicit names in their order, or the uploads of the album in the dates oldest first
+ */
+func (d *SheetService) items(uid string, so *sheetOptions) ([]*dao.SheetItem, error) {
+	if 0 == len(so.names) {
+		return d.dbi.SheetItems(uid, so.album, so.since, so.until, so.limit)
+	}
+	list := make([]*dao.SheetItem, 0, len(so.names))
+	for _, name := range so.names {
+		eTagVal, err := d.dbi.Info(uid, name)
+		if nil != err {
+			continue
+		}
+		list = append(list, &dao.SheetItem{Filename: name, ETag: eTagVal})
+	}
+	return list, nil
+}
+
+/**
+ * a fresh rendition on the disk, jpeg or webp preferred since any decoder reads them.
+ * Those without one are queued to be generated
+ */
+func (d *SheetService) rendition(uid, lev, eTagVal string) *dao.FileMeta {
+	list, err := d.dbi.Renditions(eTagVal, lev)
+	if nil != err {
+		return nil
+	}
+	var file *dao.FileMeta
+	for _, ext := range []string{".jpg", ".webp", ".avif"} {
+		for _, item := range list {
+			if nil == file && ext == item.Ext && !item.Stale {
+				file = item
+			}
+		}
+	}
+	if nil != file {
+		_, err = os.Stat(path.Join(d.rootPath, lev, eTagVal+file.Ext))
+		if nil == err {
+			return file
+		}
+		d.dbi.DropRendition(eTagVal, lev, file.Ext)
+	}
+	if _, err = d.jobs.Require(uid, eTagVal); nil != err {
+		fmt.Fprintf(os.Stderr, "require %s: %s\n", eTagVal, err.Error())
+	}
+	return nil
+}
+
+func (d *SheetService) Sheet(resp http.ResponseWriter, req *http.Request) {
+	uid := helper.GetUid(req)
+	if "" == uid {
+		StdJSONResp(resp, nil, http.StatusUnauthorized, "")
+		return
+	}
+	so, err := d.parseOptions(req)
+	if nil != err {
+		StdJSONResp(resp, nil, http.StatusBadRequest, err.Error())
+		return
+	}
+	items, err := d.items(uid, so)
+	if nil != err {
+		StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	names, eTags, files, missing := []string{}, []string{}, []*dao.FileMeta{}, []string{}
+	for _, item := range items {
+		file := d.rendition(uid, so.lev, item.ETag)
+		if nil == file {
+			missing = append(missing, item.Filename)
+			continue
+		}
+		names = append(names, item.Filename)
+		eTags = append(eTags, item.ETag)
+		files = append(files, file)
+	}
+	layout := helper.NewSheetLayout(so.cols, so.cell, "contact" == so.kind, names, eTags)
+	// the same renditions in the same layout draw the same sheet, the map is of a sprite
+	kind := so.kind
+	if "map" == kind {
+		kind = "sprite"
+	}
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "%s %s %d %d %s", kind, so.lev, so.cols, so.cell, so.fit)
+	for i, file := range files {
+		fmt.Fprintf(sb, "\n%s %s %s", names[i], file.Name, file.Hash)
+	}
+	digest, _ := helper.Sha256ByReader(strings.NewReader(sb.String()))
+	layoutETag := digest[:32]
+	if "map" == so.kind {
+		StdJSONResp(resp, &SheetMap{SheetLayout: *layout, Layout: layoutETag, Missing: missing}, 0, "")
+		return
+	}
+	// renditions generated or evicted since the map
+	if "" != so.layout && so.layout != layoutETag {
+		StdJSONResp(resp, nil, http.StatusPreconditionFailed, "Layout Changed")
+		return
+	}
+
+	ext := helper.NegotiateFormat(&req.Header, []string{".webp", ".jpg"})
+	digest, _ = helper.Sha256ByReader(strings.NewReader(layoutETag + " " + ext))
+	repETag := digest[:32]
+	respHeader := resp.Header()
+	respHeader.Set("Vary", "Cookie, Accept")
+	respHeader.Set("Cache-Control", "private, no-cache")
+	respHeader.Set("ETag", "\""+repETag+"\"")
+	if cachedETag := helper.GetNoneMatch(&req.Header); nil != cachedETag && !cachedETag.W && cachedETag.Value == repETag {
+		resp.WriteHeader(http.StatusNotModified)
+		resp.Write(nil)
+		return
+	}
+
+	absPaths := make([]string, len(files))
+	now := time.Now().Unix()
+	for i, file := range files {
+		absPaths[i] = path.Join(d.rootPath, so.lev, file.Name+file.Ext)
+		if e := d.dbi.TouchRendition(file.Name, so.lev, file.Ext, now); nil != e {
+			fmt.Fprintf(os.Stderr, "touch %s: %s\n", file.Name, e.Error())
+		}
+	}
+	buf, err := helper.RenderSheet(layout, absPaths, so.fit, ext, sheetQuality)
+	if nil != err {
+		StdJSONResp(resp, nil, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	respHeader.Set("Content-Length", strconv.Itoa(len(buf)))
+	respHeader.Set("Content-Type", mime.TypeByExtension(ext))
+	resp.WriteHeader(http.StatusOK)
+	if http.MethodHead != req.Method {
+		resp.Write(buf)
+	}
+}
+
+func (d *SheetService) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodHead:
+		fallthrough
+	case http.MethodGet:
+		d.Sheet(resp, req)
+		return
+	default:
+	}
+	StdJSONResp(resp, nil, http.StatusMethodNotAllowed, "")
+}